@@ -0,0 +1,387 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Suspicious openings are recorded like any other but carry the anomalies
+// they matched, and are indexed under opening~flagged/<id> and
+// anomaly~opening/<rule>/<id> for the anomalies query. The rules are kept in
+// state; a zero limit switches a rule off. An opening is compared with its
+// producer's openings just before and just after it in time, found through
+// the producer~time index, so openings recorded late are checked against
+// their real neighbours. Neighbours more than neighbourLookback apart are
+// not compared.
+const (
+	flaggedIndex      = "opening~flagged"
+	anomalyIndex      = "anomaly~opening"
+	neighbourLookback = 31 * msPerDay
+
+	ruleMinInterval    = "minInterval"
+	ruleMaxOpen        = "maxOpenDuration"
+	ruleImpossibleJump = "impossibleJump"
+)
+
+var anomalyRuleNames = []string{ruleMinInterval, ruleMaxOpen, ruleImpossibleJump}
+
+// AnomalyRules are the limits openings are checked against
+type AnomalyRules struct {
+	MinInterval int64   `json:"minInterval"` //ms between a producer's consecutive openings
+	MaxOpen     int64   `json:"maxOpen"`     //ms an opening may last
+	MaxSpeed    float64 `json:"maxSpeed"`    //metres per second between consecutive openings
+}
+
+// Anomaly is a rule an opening matched, and how
+type Anomaly struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+func anomalyRulesKey() (string, error) {
+	return statekey.Create("config", "anomalyRules")
+}
+
+func readAnomalyRules(stub shim.ChaincodeStubInterface) (AnomalyRules, error) {
+	var rules AnomalyRules
+	key, err := anomalyRulesKey()
+	if err != nil {
+		return rules, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return rules, err
+	}
+	if len(val) == 0 {
+		return rules, nil
+	}
+	err = json.Unmarshal(val, &rules)
+	if err != nil {
+		return rules, errors.New("Corrupt anomaly rules " + string(val))
+	}
+	return rules, nil
+}
+
+func flag(openbin *OpenBinObj, rule string, detail string) {
+	openbin.Anomalies = append(openbin.Anomalies, Anomaly{Rule: rule, Detail: detail})
+}
+
+func flaggedFor(openbin *OpenBinObj, rule string) bool {
+	for _, anomaly := range openbin.Anomalies {
+		if anomaly.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOpenDuration flags an opening that lasted too long: a closed one by
+// how long it lasted, one still open by how long it has been open at asOf.
+// An opening is flagged for this rule once.
+func checkOpenDuration(rules *AnomalyRules, openbin *OpenBinObj, asOf int64) {
+	if rules.MaxOpen == 0 || flaggedFor(openbin, ruleMaxOpen) {
+		return
+	}
+	if openbin.TimestampClosed != 0 {
+		if open := openbin.TimestampClosed - openbin.TimestampOpened; open > rules.MaxOpen {
+			flag(openbin, ruleMaxOpen, fmt.Sprintf("open for %d ms, more than %d", open, rules.MaxOpen))
+		}
+		return
+	}
+	if open := asOf - openbin.TimestampOpened; open > rules.MaxOpen {
+		flag(openbin, ruleMaxOpen, fmt.Sprintf("still open after %d ms, more than %d", open, rules.MaxOpen))
+	}
+}
+
+// flagStillOpen flags a recorded opening that has been open too long at
+// asOf, and reports whether it did
+func flagStillOpen(stub shim.ChaincodeStubInterface, rules *AnomalyRules, id uint32, asOf int64) (bool, error) {
+	openbin, key, err := locateOpening(stub, id)
+	if err != nil || openbin == nil || openbin.TimestampClosed != 0 {
+		return false, err
+	}
+	flagged := len(openbin.Anomalies)
+	checkOpenDuration(rules, openbin, asOf)
+	if len(openbin.Anomalies) == flagged {
+		return false, nil
+	}
+	err = writeOpening(stub, key, openbin)
+	if err != nil {
+		return false, err
+	}
+	return true, indexAnomalies(stub, openbin)
+}
+
+// checkPreviousOpening flags the opening just before a new one if it is
+// still open and has been open too long at asOf. Openings that are never
+// closed are caught here, or by flagOpenOpenings.
+func checkPreviousOpening(stub shim.ChaincodeStubInterface, prev *OpenBinObj, asOf int64) error {
+	if prev == nil {
+		return nil
+	}
+	rules, err := readAnomalyRules(stub)
+	if err != nil || rules.MaxOpen == 0 {
+		return err
+	}
+	_, err = flagStillOpen(stub, &rules, prev.Id, asOf)
+	return err
+}
+
+// checkOpening flags a new opening that matches any rule at asOf. It
+// returns the producer's opening just before the new one, or nil.
+func checkOpening(stub shim.ChaincodeStubInterface, openbin *OpenBinObj, asOf int64) (*OpenBinObj, error) {
+	rules, err := readAnomalyRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	checkOpenDuration(&rules, openbin, asOf)
+	if rules == (AnomalyRules{}) {
+		return nil, nil
+	}
+	opened := openbin.TimestampOpened
+	prev, err := previousOpening(stub, openbin.Producer, opened-neighbourLookback, opened)
+	if err != nil {
+		return nil, err
+	}
+	if rules.MinInterval == 0 && rules.MaxSpeed == 0 {
+		return prev, nil
+	}
+	next, err := nextOpening(stub, openbin.Producer, opened, opened+neighbourLookback)
+	if err != nil {
+		return nil, err
+	}
+	for _, neighbour := range []*OpenBinObj{prev, next} {
+		if neighbour != nil {
+			checkNeighbour(&rules, openbin, neighbour)
+		}
+	}
+	return prev, nil
+}
+
+// checkNeighbour flags an opening too close in time, or too far in space,
+// to another opening of its producer
+func checkNeighbour(rules *AnomalyRules, openbin *OpenBinObj, neighbour *OpenBinObj) {
+	interval := openbin.TimestampOpened - neighbour.TimestampOpened
+	if interval < 0 {
+		interval = -interval
+	}
+	if rules.MinInterval != 0 && interval < rules.MinInterval && !flaggedFor(openbin, ruleMinInterval) {
+		flag(openbin, ruleMinInterval, fmt.Sprintf("%d ms from opening %d, less than %d", interval, neighbour.Id, rules.MinInterval))
+	}
+	if rules.MaxSpeed != 0 && !flaggedFor(openbin, ruleImpossibleJump) {
+		metres := distance(neighbour.Lat, neighbour.Lng, openbin.Lat, openbin.Lng)
+		// two places at once is a jump at any speed
+		if metres > 0 && (interval == 0 || metres/(float64(interval)/1000) > rules.MaxSpeed) {
+			flag(openbin, ruleImpossibleJump, fmt.Sprintf("%.0f m from opening %d in %d ms", metres, neighbour.Id, interval))
+		}
+	}
+}
+
+// anomalyKeys returns the index keys of a flagged opening
+func anomalyKeys(openbin *OpenBinObj) ([]string, error) {
+	if len(openbin.Anomalies) == 0 {
+		return nil, nil
+	}
+	id := statekey.Uint(uint64(openbin.Id))
+	key, err := statekey.Create(flaggedIndex, id)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{key}
+	for _, anomaly := range openbin.Anomalies {
+		key, err = statekey.Create(anomalyIndex, anomaly.Rule, id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// indexAnomalies writes the index keys of a flagged opening
+func indexAnomalies(stub shim.ChaincodeStubInterface, openbin *OpenBinObj) error {
+	keys, err := anomalyKeys(openbin)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.PutState(key, statekey.IndexValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenScan is the result of flagOpenOpenings
+type OpenScan struct {
+	Flagged    []uint32 `json:"flagged"`
+	NextCursor string   `json:"nextCursor"`
+}
+
+// flagOpenOpenings pages through the openings that are still open and flags
+// those open longer than maxOpen at the time of the transaction: pageSize,
+// cursor. Only admins may run it.
+func (t *SimpleChaincode) flagOpenOpenings(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	err := requireAdmin(caller, "flagOpenOpenings")
+	if err != nil {
+		return nil, err
+	}
+	pageSize, cursor, err := pager.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := readAnomalyRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := statekey.PrefixRange(openIndex)
+	if err != nil {
+		return nil, err
+	}
+	scan := OpenScan{Flagged: make([]uint32, 0)}
+	scan.NextCursor, err = pager.Scan(stub, start, end, pageSize, cursor, func(key string, _ []byte) (bool, error) {
+		id, err := openingIdFromIndexKey(key)
+		if err != nil {
+			return false, err
+		}
+		flagged, err := flagStillOpen(stub, &rules, id, now)
+		if err != nil {
+			return false, err
+		}
+		if flagged {
+			scan.Flagged = append(scan.Flagged, id)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&scan)
+}
+
+// setAnomalyRules sets the limits openings are checked against:
+// minInterval (ms), maxOpen (ms), maxSpeed (metres per second). Zero
+// switches a rule off. Openings already recorded keep their flags.
+func (t *SimpleChaincode) setAnomalyRules(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting minInterval, maxOpen, maxSpeed")
+	}
+	err := requireAdmin(caller, "setAnomalyRules")
+	if err != nil {
+		return nil, err
+	}
+	var rules AnomalyRules
+	rules.MinInterval, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil || rules.MinInterval < 0 {
+		return nil, invalid("minInterval", "must be a non-negative number of ms")
+	}
+	rules.MaxOpen, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil || rules.MaxOpen < 0 {
+		return nil, invalid("maxOpen", "must be a non-negative number of ms")
+	}
+	rules.MaxSpeed, err = strconv.ParseFloat(args[2], 64)
+	if err != nil || !(rules.MaxSpeed >= 0) || math.IsInf(rules.MaxSpeed, 0) {
+		return nil, invalid("maxSpeed", "must be a non-negative number of metres per second")
+	}
+	key, err := anomalyRulesKey()
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&rules)
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(key, val)
+}
+
+// readAnomalyRuleTable returns the rules in force. Only admins may read them.
+func readAnomalyRuleTable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	err := requireAdminRead(stub, "readanomalyrules")
+	if err != nil {
+		return nil, err
+	}
+	rules, err := readAnomalyRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&rules)
+}
+
+// readAnomalies pages through flagged openings by ID: rule, pageSize,
+// cursor. An empty rule selects openings matching any rule. Only admins may
+// read them.
+func readAnomalies(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := requireAdminRead(stub, "anomalies")
+	if err != nil {
+		return nil, err
+	}
+	rule := ""
+	if len(args) > 0 {
+		rule = args[0]
+	}
+	var pageArgs []string
+	if len(args) > 1 {
+		pageArgs = args[1:]
+	}
+	pageSize, cursor, err := pager.ParseArgs(pageArgs)
+	if err != nil {
+		return nil, err
+	}
+	var start, end string
+	if rule == "" {
+		start, end, err = statekey.PrefixRange(flaggedIndex)
+	} else if contains(anomalyRuleNames, rule) {
+		start, end, err = statekey.PrefixRange(anomalyIndex, rule)
+	} else {
+		return nil, invalid("rule", "must be one of minInterval, maxOpenDuration, impossibleJump")
+	}
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageOpenings(stub, start, end, pageSize, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
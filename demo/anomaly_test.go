@@ -0,0 +1,100 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// at returns a timestamp argument hours after deployment
+func at(hours float64) string {
+	return strconv.FormatInt(deployedAt+int64(hours*msPerHour), 10)
+}
+
+// rules returns the rules an opening matched
+func (n *testNet) rules(id string) []string {
+	rules := make([]string, 0)
+	for _, anomaly := range n.opening(id).Anomalies {
+		rules = append(rules, anomaly.Rule)
+	}
+	return rules
+}
+
+func TestAnomalyNeighbours(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b2", "glass", "240", "46", "10")
+	net.mustInvoke("root", roleAdmin, "setAnomalyRules", "60000", "0", "50")
+	net.stub.Timestamp = deployedAt + 5*msPerHour
+	net.mustInvoke("alice", "", "newOpening", "b1", at(2))
+	net.mustInvoke("alice", "", "newOpening", "b1", at(4))
+	// recorded late, each is checked against the openings either side of it
+	// rather than the one recorded last
+	net.mustInvoke("alice", "", "newOpening", "b2", at(2.01))
+	net.mustInvoke("alice", "", "newOpening", "b1", at(3.99))
+
+	tests := []struct {
+		id    string
+		rules []string
+	}{
+		{"1", []string{}},
+		{"2", []string{}},
+		{"3", []string{ruleMinInterval, ruleImpossibleJump}},
+		{"4", []string{ruleMinInterval}},
+	}
+	for _, tt := range tests {
+		if rules := net.rules(tt.id); !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("opening %s matched %v, want %v", tt.id, rules, tt.rules)
+		}
+	}
+	if ids, _ := net.page("anomalies", ruleMinInterval); !reflect.DeepEqual(ids, []uint32{3, 4}) {
+		t.Errorf("anomalies %s = %v, want [3 4]", ruleMinInterval, ids)
+	}
+}
+
+func TestPreviousOpeningStillOpen(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("root", roleAdmin, "setAnomalyRules", "0", strconv.Itoa(msPerHour), "0")
+	net.stub.Timestamp = deployedAt + 1*msPerHour
+	net.mustInvoke("alice", "", "newOpening", "b1", at(1))
+	net.stub.Timestamp = deployedAt + 3*msPerHour
+	net.mustInvoke("alice", "", "newOpening", "b1", at(3))
+
+	if rules := net.rules("1"); !reflect.DeepEqual(rules, []string{ruleMaxOpen}) {
+		t.Errorf("opening 1 matched %v, want [%s]", rules, ruleMaxOpen)
+	}
+	if rules := net.rules("2"); len(rules) != 0 {
+		t.Errorf("opening 2 matched %v, want none", rules)
+	}
+}
+
+func TestAnomalyQueriesNeedAdmin(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	for _, function := range []string{"anomalies", "readanomalyrules"} {
+		for _, role := range []string{"", "producer"} {
+			if _, err := net.query("alice", role, function); err == nil {
+				t.Errorf("%s with role %q succeeded", function, role)
+			}
+		}
+		if _, err := net.query("root", roleAdmin, function); err != nil {
+			t.Errorf("%s as admin: %v", function, err)
+		}
+	}
+}
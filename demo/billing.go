@@ -0,0 +1,547 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Producers pay per opening. The tariff table lives under
+// tariff/<binType>/<fromHour>/<effectiveFrom>: each entry prices openings of
+// a bin type during a band of UTC hours from its effective time on, and the
+// bin type "*" prices bins of any type without a band of their own. Changing
+// or removing a band adds a version rather than rewriting it, so an opening
+// is always priced with the tariffs in effect when it was opened. A bill
+// prices a producer's openings in a period; freezing it stores an invoice
+// under invoice/<producer>/<from> that is never rewritten, and no opening may
+// be recorded in an invoiced period afterwards.
+const (
+	tariffTable     = "tariff"
+	invoiceTable    = "invoice"
+	anyBinType      = "*"
+	msPerHour       = 60 * 60 * 1000
+	maxBillOpenings = 10 * pager.MaxSize
+)
+
+// Tariff is the price of one opening, in the smallest currency unit, of a
+// bin of BinType opened in [FromHour, ToHour) UTC at or after EffectiveFrom.
+// A removed version ends the band starting at FromHour.
+type Tariff struct {
+	BinType       string `json:"binType"`
+	FromHour      int    `json:"fromHour"`
+	ToHour        int    `json:"toHour"`
+	Price         int64  `json:"price"`
+	EffectiveFrom int64  `json:"effectiveFrom"`
+	Removed       bool   `json:"removed,omitempty"`
+}
+
+// BillLine is one priced opening
+type BillLine struct {
+	OpeningId       uint32 `json:"openingId"`
+	BinId           string `json:"binId"`
+	BinType         string `json:"binType"`
+	TimestampOpened int64  `json:"timestampOpened"`
+	Price           int64  `json:"price"`
+}
+
+// Bill is what a producer owes for the openings in [From, To). Unpriced
+// lists the openings no tariff covered, which are not in the total.
+type Bill struct {
+	Producer string     `json:"producer"`
+	From     int64      `json:"from"`
+	To       int64      `json:"to"`
+	Lines    []BillLine `json:"lines"`
+	Unpriced []BillLine `json:"unpriced"`
+	Total    int64      `json:"total"`
+}
+
+// Invoice is a bill frozen by an invoice transaction
+type Invoice struct {
+	Bill
+	IssuedBy        string `json:"issuedBy"`
+	TimestampIssued int64  `json:"timestampIssued"`
+	TxID            string `json:"txId"`
+}
+
+func tariffKey(binType string, fromHour int, effectiveFrom int64) (string, error) {
+	return statekey.Create(tariffTable, binType, statekey.Uint(uint64(fromHour)), statekey.Int(effectiveFrom))
+}
+
+// readTariffs returns every version of the bands of a bin type, or of every
+// type if binType is empty, ordered by type, hour and effective time
+func readTariffs(stub shim.ChaincodeStubInterface, binType string) ([]Tariff, error) {
+	var start, end string
+	var err error
+	if binType == "" {
+		start, end, err = statekey.PrefixRange(tariffTable)
+	} else {
+		start, end, err = statekey.PrefixRange(tariffTable, binType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	tariffs := make([]Tariff, 0)
+	for iter.HasNext() {
+		_, val, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var tariff Tariff
+		err = json.Unmarshal(val, &tariff)
+		if err != nil {
+			return nil, errors.New("Corrupt tariff " + string(val))
+		}
+		tariffs = append(tariffs, tariff)
+	}
+	return tariffs, nil
+}
+
+// hourOfDay returns the UTC hour a timestamp in ms falls in
+func hourOfDay(ts int64) int {
+	ms := ts % msPerDay
+	if ms < 0 {
+		ms += msPerDay
+	}
+	return int(ms / msPerHour)
+}
+
+// bandsAt returns the bands in effect at ts among versions ordered by type,
+// hour and effective time: the latest version of each band that took effect
+// by then, unless it was removed
+func bandsAt(versions []Tariff, ts int64) []Tariff {
+	bands := make([]Tariff, 0)
+	for _, v := range versions {
+		if v.EffectiveFrom > ts {
+			continue
+		}
+		last := len(bands) - 1
+		if last >= 0 && bands[last].BinType == v.BinType && bands[last].FromHour == v.FromHour {
+			bands = bands[:last]
+		}
+		bands = append(bands, v)
+	}
+	current := bands[:0]
+	for _, band := range bands {
+		if !band.Removed {
+			current = append(current, band)
+		}
+	}
+	return current
+}
+
+// latestVersion returns the effective time of the newest version among
+// versions, or 0 if there are none
+func latestVersion(versions []Tariff) int64 {
+	var latest int64
+	for _, v := range versions {
+		if v.EffectiveFrom > latest {
+			latest = v.EffectiveFrom
+		}
+	}
+	return latest
+}
+
+// tariffsByType returns every version of the tariff table keyed by bin type
+func tariffsByType(stub shim.ChaincodeStubInterface) (map[string][]Tariff, error) {
+	tariffs, err := readTariffs(stub, "")
+	if err != nil {
+		return nil, err
+	}
+	byType := make(map[string][]Tariff)
+	for _, tariff := range tariffs {
+		byType[tariff.BinType] = append(byType[tariff.BinType], tariff)
+	}
+	return byType, nil
+}
+
+// priceOpening returns what an opening of a bin of binType cost under the
+// tariffs in effect when it was opened, or false if none covered it
+func priceOpening(tariffs map[string][]Tariff, binType string, openbin *OpenBinObj) (int64, bool) {
+	hour := hourOfDay(openbin.TimestampOpened)
+	for _, t := range []string{binType, anyBinType} {
+		if t == "" {
+			continue
+		}
+		for _, tariff := range bandsAt(tariffs[t], openbin.TimestampOpened) {
+			if hour >= tariff.FromHour && hour < tariff.ToHour {
+				return tariff.Price, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// computeBill prices every opening a producer made in [from, to)
+func computeBill(stub shim.ChaincodeStubInterface, producer string, from int64, to int64) (Bill, error) {
+	bill := Bill{Producer: producer, From: from, To: to, Lines: make([]BillLine, 0), Unpriced: make([]BillLine, 0)}
+	start, end, err := timeRange(producer, from, to)
+	if err != nil {
+		return bill, err
+	}
+	tariffs, err := tariffsByType(stub)
+	if err != nil {
+		return bill, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return bill, err
+	}
+	defer iter.Close()
+
+	binTypes := make(map[string]string)
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return bill, err
+		}
+		if len(bill.Lines)+len(bill.Unpriced) == maxBillOpenings {
+			return bill, fmt.Errorf("More than %d openings in the period. Bill a shorter period", maxBillOpenings)
+		}
+		id, err := openingIdFromIndexKey(key)
+		if err != nil {
+			return bill, err
+		}
+		openbin, err := readOpening(stub, id)
+		if err != nil {
+			return bill, err
+		}
+		binType, ok := binTypes[openbin.BinId]
+		if !ok && openbin.BinId != "" {
+			bin, err := readBin(stub, openbin.BinId)
+			if err != nil {
+				return bill, err
+			}
+			binType = bin.Type
+			binTypes[openbin.BinId] = binType
+		}
+		line := BillLine{OpeningId: openbin.Id, BinId: openbin.BinId, BinType: binType, TimestampOpened: openbin.TimestampOpened}
+		price, ok := priceOpening(tariffs, binType, &openbin)
+		if !ok {
+			bill.Unpriced = append(bill.Unpriced, line)
+			continue
+		}
+		line.Price = price
+		bill.Lines = append(bill.Lines, line)
+		bill.Total += price
+	}
+	return bill, nil
+}
+
+// readInvoices returns a producer's invoices in period order
+func readInvoices(stub shim.ChaincodeStubInterface, producer string) ([]Invoice, error) {
+	start, end, err := statekey.PrefixRange(invoiceTable, producer)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	invoices := make([]Invoice, 0)
+	for iter.HasNext() {
+		_, val, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var invoice Invoice
+		err = json.Unmarshal(val, &invoice)
+		if err != nil {
+			return nil, errors.New("Corrupt invoice " + string(val))
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, nil
+}
+
+// invoicedAt reports whether a producer has been invoiced for a period
+// overlapping [from, to)
+func invoicedAt(stub shim.ChaincodeStubInterface, producer string, from int64, to int64) (bool, error) {
+	invoices, err := readInvoices(stub, producer)
+	if err != nil {
+		return false, err
+	}
+	for _, invoice := range invoices {
+		if from < invoice.To && invoice.From < to {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parsePeriod reads the producer, from and to arguments of a billing period
+func parsePeriod(args []string) (string, int64, int64, error) {
+	if len(args) != 3 {
+		return "", 0, 0, errors.New("Incorrect number of arguments. Expecting producer, from, to")
+	}
+	if err := validateProducer(args[0]); err != nil {
+		return "", 0, 0, err
+	}
+	from, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, invalid("from", "not an integer timestamp in ms")
+	}
+	to, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "", 0, 0, invalid("to", "not an integer timestamp in ms")
+	}
+	if to <= from {
+		return "", 0, 0, invalid("to", "must be after from")
+	}
+	return args[0], from, to, nil
+}
+
+// parseEffectiveFrom reads the optional effectiveFrom argument of a tariff
+// change, which defaults to now. Versions of a bin type are added in
+// effective order, so a change may not take effect before the latest one.
+func parseEffectiveFrom(args []string, versions []Tariff, now int64) (int64, error) {
+	effectiveFrom := now
+	if len(args) != 0 {
+		var err error
+		effectiveFrom, err = strconv.ParseInt(args[0], 10, 64)
+		if err != nil || effectiveFrom <= 0 {
+			return 0, invalid("effectiveFrom", "not a positive timestamp in ms")
+		}
+	}
+	if effectiveFrom < latestVersion(versions) {
+		return 0, invalid("effectiveFrom", "is before the latest change to the bin type")
+	}
+	return effectiveFrom, nil
+}
+
+// putTariff stores a version of a band
+func putTariff(stub shim.ChaincodeStubInterface, tariff *Tariff) error {
+	key, err := tariffKey(tariff.BinType, tariff.FromHour, tariff.EffectiveFrom)
+	if err != nil {
+		return invalid("binType", "contains a reserved character")
+	}
+	val, err := json.Marshal(tariff)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, val)
+}
+
+// setTariff prices openings of a bin type during a band of UTC hours from
+// effectiveFrom on: binType, fromHour, toHour, price and optionally
+// effectiveFrom, which defaults to now. The bin type "*" applies to bins
+// whose type has no band covering the hour. Bands of a type may not overlap;
+// a band starting at the same hour is replaced. Openings before
+// effectiveFrom keep the price they had.
+func (t *SimpleChaincode) setTariff(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting binType, fromHour, toHour, price and optionally effectiveFrom")
+	}
+	err := requireAdmin(caller, "setTariff")
+	if err != nil {
+		return nil, err
+	}
+	tariff := Tariff{BinType: args[0]}
+	if tariff.BinType == "" {
+		return nil, invalid("binType", "must not be empty")
+	}
+	tariff.FromHour, err = strconv.Atoi(args[1])
+	if err != nil || tariff.FromHour < 0 || tariff.FromHour > 23 {
+		return nil, invalid("fromHour", "must be 0 to 23")
+	}
+	tariff.ToHour, err = strconv.Atoi(args[2])
+	if err != nil || tariff.ToHour <= tariff.FromHour || tariff.ToHour > 24 {
+		return nil, invalid("toHour", "must be after fromHour and at most 24")
+	}
+	tariff.Price, err = strconv.ParseInt(args[3], 10, 64)
+	if err != nil || tariff.Price < 0 {
+		return nil, invalid("price", "must be a non-negative integer")
+	}
+	now, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := readTariffs(stub, tariff.BinType)
+	if err != nil {
+		return nil, err
+	}
+	tariff.EffectiveFrom, err = parseEffectiveFrom(args[4:], versions, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range bandsAt(versions, tariff.EffectiveFrom) {
+		if other.FromHour != tariff.FromHour && tariff.FromHour < other.ToHour && other.FromHour < tariff.ToHour {
+			return nil, invalid("fromHour", fmt.Sprintf("overlaps the %02d-%02d band", other.FromHour, other.ToHour))
+		}
+	}
+	return nil, putTariff(stub, &tariff)
+}
+
+// removeTariff ends a band of the tariff table from effectiveFrom on:
+// binType, fromHour and optionally effectiveFrom, which defaults to now.
+// Openings before effectiveFrom keep the price they had.
+func (t *SimpleChaincode) removeTariff(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting binType, fromHour and optionally effectiveFrom")
+	}
+	err := requireAdmin(caller, "removeTariff")
+	if err != nil {
+		return nil, err
+	}
+	fromHour, err := strconv.Atoi(args[1])
+	if err != nil || fromHour < 0 || fromHour > 23 {
+		return nil, invalid("fromHour", "must be 0 to 23")
+	}
+	now, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := readTariffs(stub, args[0])
+	if err != nil {
+		return nil, invalid("binType", "contains a reserved character")
+	}
+	effectiveFrom, err := parseEffectiveFrom(args[2:], versions, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, band := range bandsAt(versions, effectiveFrom) {
+		if band.FromHour == fromHour {
+			band.Removed = true
+			band.EffectiveFrom = effectiveFrom
+			return nil, putTariff(stub, &band)
+		}
+	}
+	return nil, invalid("fromHour", "no band of the bin type starts at that hour")
+}
+
+// freezeInvoice bills a producer for a period that has ended and stores the
+// bill as an invoice: producer, from, to. Periods may not overlap an earlier
+// invoice of the same producer.
+func (t *SimpleChaincode) freezeInvoice(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	err := requireAdmin(caller, "freezeInvoice")
+	if err != nil {
+		return nil, err
+	}
+	producer, from, to, err := parsePeriod(args)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if to > now {
+		return nil, invalid("to", "the period has not ended yet")
+	}
+	invoiced, err := invoicedAt(stub, producer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if invoiced {
+		return nil, invalid("from", "the period overlaps an existing invoice")
+	}
+	bill, err := computeBill(stub, producer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(bill.Unpriced) != 0 {
+		return nil, fmt.Errorf("No tariff was in effect for opening %d. Set one effective from before it, then freeze the invoice", bill.Unpriced[0].OpeningId)
+	}
+	invoice := Invoice{Bill: bill, IssuedBy: caller.User, TimestampIssued: now, TxID: stub.GetTxID()}
+	key, err := statekey.Create(invoiceTable, producer, statekey.Int(from))
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&invoice)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, val)
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// readBill prices a producer's openings in a period without storing
+// anything: producer, from, to. Only the producer and admins may read it.
+func readBill(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	producer, from, to, err := parsePeriod(args)
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeProducerRead(stub, producer)
+	if err != nil {
+		return nil, err
+	}
+	bill, err := computeBill(stub, producer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&bill)
+}
+
+// readTariffTable lists the bands in effect at a time, ordered by bin type
+// and hour: optionally at. Without it, the latest version of every band is
+// listed, including changes that have yet to take effect.
+func readTariffTable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting at")
+	}
+	at := int64(math.MaxInt64)
+	if len(args) == 1 {
+		var err error
+		at, err = strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, invalid("at", "not an integer timestamp in ms")
+		}
+	}
+	versions, err := readTariffs(stub, "")
+	if err != nil {
+		return nil, err
+	}
+	bands := bandsAt(versions, at)
+	return json.Marshal(&bands)
+}
+
+// readProducerInvoices lists a producer's invoices in period order:
+// producer. Only the producer and admins may read them.
+func readProducerInvoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting producer")
+	}
+	err := authorizeProducerRead(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	invoices, err := readInvoices(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&invoices)
+}
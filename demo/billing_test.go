@@ -0,0 +1,111 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestBillAccess(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("root", roleAdmin, "setTariff", "*", "0", "24", "7")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748803000")
+	tests := []struct {
+		user    string
+		role    string
+		allowed bool
+	}{
+		{"alice", "", true},
+		{"bob", "", false},
+		{"bob", "producer", false},
+		{"root", roleAdmin, true},
+	}
+	for _, tt := range tests {
+		for _, q := range [][]string{{"bill", "alice", "0", "1476748900000"}, {"readinvoices", "alice"}} {
+			_, err := net.query(tt.user, tt.role, q[0], q[1:]...)
+			if (err == nil) != tt.allowed {
+				t.Errorf("%s as %s (%s): error = %v, allowed %v", q[0], tt.user, tt.role, err, tt.allowed)
+			}
+		}
+	}
+}
+
+func TestTariffVersions(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("root", roleAdmin, "setTariff", "*", "0", "24", "7")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748803000")
+	net.mustInvoke("root", roleAdmin, "setTariff", "*", "0", "24", "9")
+	// recorded after the price change, but opened before it
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748803500")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748805000")
+	net.mustInvoke("root", roleAdmin, "removeTariff", "*", "0")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748807500")
+
+	to := strconv.FormatInt(net.stub.Timestamp, 10)
+	val, err := net.query("alice", "", "bill", "alice", "0", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bill Bill
+	if err := json.Unmarshal(val, &bill); err != nil {
+		t.Fatal(err)
+	}
+	prices := make([]int64, 0)
+	for _, line := range bill.Lines {
+		prices = append(prices, line.Price)
+	}
+	if !reflect.DeepEqual(prices, []int64{7, 7, 9}) || bill.Total != 23 {
+		t.Errorf("prices = %v, total %d; want [7 7 9], total 23", prices, bill.Total)
+	}
+	if len(bill.Unpriced) != 1 || bill.Unpriced[0].OpeningId != 4 {
+		t.Errorf("unpriced = %+v, want opening 4", bill.Unpriced)
+	}
+	if err := net.invoke("root", roleAdmin, "freezeInvoice", "alice", "0", to); err == nil {
+		t.Error("freezeInvoice with an unpriced opening succeeded")
+	}
+
+	tests := []struct {
+		function string
+		args     []string
+	}{
+		{"removeTariff", []string{"*", "24"}},
+		{"removeTariff", []string{"*", "5"}},
+		{"setTariff", []string{"*", "0", "24", "5", "1476748803000"}},
+	}
+	for _, tt := range tests {
+		if err := net.invoke("root", roleAdmin, tt.function, tt.args...); err == nil {
+			t.Errorf("%s %v succeeded", tt.function, tt.args)
+		}
+	}
+
+	val, err = net.query("alice", "", "readtariffs", "1476748803000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bands []Tariff
+	if err := json.Unmarshal(val, &bands); err != nil {
+		t.Fatal(err)
+	}
+	if len(bands) != 1 || bands[0].Price != 7 {
+		t.Errorf("bands at 1476748803000 = %+v, want the 7 band", bands)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Every physical bin is registered under bin/<id>. A bin keeps every
+// position it has had, and an opening takes its coordinates from where the
+// bin stood when it was opened, so relocating a bin does not move past
+// openings, even ones recorded after the move. An opening may not be dated
+// before its bin was registered, nor after it was decommissioned;
+// decommissioned bins stay registered for their past openings. Only callers
+// with the admin role maintain the registry.
+const (
+	binTable = "bin"
+
+	binActive         = "active"
+	binDecommissioned = "decommissioned"
+)
+
+// Bin is a registered physical bin
+type Bin struct {
+	Id                      string        `json:"id"`
+	Type                    string        `json:"type"`     //what the bin takes, e.g. paper or glass
+	Capacity                int           `json:"capacity"` //litres
+	Lat                     float64       `json:"lat"`
+	Lng                     float64       `json:"lng"`
+	Status                  string        `json:"status"` //active or decommissioned
+	TimestampRegistered     int64         `json:"timestampRegistered"`
+	TimestampRelocated      int64         `json:"timestampRelocated"`
+	TimestampDecommissioned int64         `json:"timestampDecommissioned"`
+	Locations               []BinLocation `json:"locations"` //oldest first
+}
+
+// BinLocation is where a bin stood from Since on
+type BinLocation struct {
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+	Since int64   `json:"since"`
+}
+
+// locationAt returns where a bin stood at ts, which must not be before the
+// bin was registered
+func (bin *Bin) locationAt(ts int64) (float64, float64) {
+	at := bin.Locations[0]
+	for _, loc := range bin.Locations[1:] {
+		if loc.Since > ts {
+			break
+		}
+		at = loc
+	}
+	return at.Lat, at.Lng
+}
+
+// BinPage is one page of readbins
+type BinPage struct {
+	Items      []Bin  `json:"items"`
+	NextCursor string `json:"nextCursor"`
+}
+
+func binKey(id string) (string, error) {
+	return statekey.Create(binTable, id)
+}
+
+// findBin returns a registered bin, or nil if there is none with that ID
+func findBin(stub shim.ChaincodeStubInterface, id string) (*Bin, error) {
+	key, err := binKey(id)
+	if err != nil {
+		return nil, invalid("bin", "contains a reserved character")
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var bin Bin
+	err = json.Unmarshal(val, &bin)
+	if err != nil {
+		return nil, errors.New("Corrupt bin record " + string(val))
+	}
+	return &bin, nil
+}
+
+func readBin(stub shim.ChaincodeStubInterface, id string) (*Bin, error) {
+	bin, err := findBin(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	if bin == nil {
+		return nil, errors.New("Bin " + id + " not found")
+	}
+	return bin, nil
+}
+
+func writeBin(stub shim.ChaincodeStubInterface, bin *Bin) error {
+	key, err := binKey(bin.Id)
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(bin)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, val)
+}
+
+// openableBin returns the bin an opening refers to, which must be registered
+func openableBin(stub shim.ChaincodeStubInterface, id string) (*Bin, error) {
+	bin, err := findBin(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	if bin == nil {
+		return nil, invalid("bin", "is not registered")
+	}
+	return bin, nil
+}
+
+// checkOpenedAt fails unless the bin was in service at ts
+func (bin *Bin) checkOpenedAt(ts int64) error {
+	if ts < bin.TimestampRegistered {
+		return invalid("open", "is before the bin was registered")
+	}
+	if bin.Status != binActive && ts >= bin.TimestampDecommissioned {
+		return invalid("open", "is after the bin was decommissioned")
+	}
+	return nil
+}
+
+// registerBin adds a bin to the registry: id, type, capacity, lat, lng
+func (t *SimpleChaincode) registerBin(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, type, capacity, lat, lng")
+	}
+	err := requireAdmin(caller, "registerBin")
+	if err != nil {
+		return nil, err
+	}
+	bin := Bin{Id: args[0], Type: strings.TrimSpace(args[1]), Status: binActive}
+	if strings.TrimSpace(bin.Id) == "" {
+		return nil, invalid("id", "must not be empty")
+	}
+	if bin.Type == "" {
+		return nil, invalid("type", "must not be empty")
+	}
+	bin.Capacity, err = strconv.Atoi(args[2])
+	if err != nil || bin.Capacity <= 0 {
+		return nil, invalid("capacity", "must be a positive number of litres")
+	}
+	if bin.Lat, err = parseLatLng("lat", args[3], 90); err != nil {
+		return nil, err
+	}
+	if bin.Lng, err = parseLatLng("lng", args[4], 180); err != nil {
+		return nil, err
+	}
+	existing, err := findBin(stub, bin.Id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.New("Bin " + bin.Id + " already exists")
+	}
+	if bin.TimestampRegistered, err = t.now(stub); err != nil {
+		return nil, err
+	}
+	bin.Locations = []BinLocation{{Lat: bin.Lat, Lng: bin.Lng, Since: bin.TimestampRegistered}}
+	return nil, writeBin(stub, &bin)
+}
+
+// relocateBin moves an active bin from now on: id, lat, lng
+func (t *SimpleChaincode) relocateBin(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, lat, lng")
+	}
+	err := requireAdmin(caller, "relocateBin")
+	if err != nil {
+		return nil, err
+	}
+	lat, err := parseLatLng("lat", args[1], 90)
+	if err != nil {
+		return nil, err
+	}
+	lng, err := parseLatLng("lng", args[2], 180)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := readBin(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bin.Status != binActive {
+		return nil, errors.New("Bin " + bin.Id + " is decommissioned")
+	}
+	if bin.TimestampRelocated, err = t.now(stub); err != nil {
+		return nil, err
+	}
+	bin.Lat, bin.Lng = lat, lng
+	bin.Locations = append(bin.Locations, BinLocation{Lat: lat, Lng: lng, Since: bin.TimestampRelocated})
+	return nil, writeBin(stub, bin)
+}
+
+// decommissionBin takes a bin out of service from now on: id. Its past
+// openings are kept, and openings dated before now may still be recorded.
+func (t *SimpleChaincode) decommissionBin(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id")
+	}
+	err := requireAdmin(caller, "decommissionBin")
+	if err != nil {
+		return nil, err
+	}
+	bin, err := readBin(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bin.Status != binActive {
+		return nil, errors.New("Bin " + bin.Id + " is already decommissioned")
+	}
+	bin.Status = binDecommissioned
+	if bin.TimestampDecommissioned, err = t.now(stub); err != nil {
+		return nil, err
+	}
+	return nil, writeBin(stub, bin)
+}
+
+// readBinById returns one bin: id
+func readBinById(stub shim.ChaincodeStubInterface, id string) ([]byte, error) {
+	bin, err := readBin(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(bin)
+}
+
+// readBins pages through the registry in ID order: pageSize, cursor
+func readBins(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	pageSize, cursor, err := pager.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := statekey.PrefixRange(binTable)
+	if err != nil {
+		return nil, err
+	}
+	page := BinPage{Items: make([]Bin, 0)}
+	page.NextCursor, err = pager.Scan(stub, start, end, pageSize, cursor, func(_ string, val []byte) (bool, error) {
+		var bin Bin
+		err := json.Unmarshal(val, &bin)
+		if err != nil {
+			return false, errors.New("Corrupt bin record " + string(val))
+		}
+		page.Items = append(page.Items, bin)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
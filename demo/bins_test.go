@@ -0,0 +1,96 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestAdminFunctions(t *testing.T) {
+	tests := []struct {
+		function string
+		args     []string
+	}{
+		{"registerBin", []string{"b2", "paper", "240", "45", "9"}},
+		{"relocateBin", []string{"b1", "46", "10"}},
+		{"setTariff", []string{"glass", "0", "24", "5"}},
+		{"removeTariff", []string{"glass", "0"}},
+		{"freezeInvoice", []string{"alice", "0", "1476748800000"}},
+		{"setAnomalyRules", []string{"0", "60000", "0"}},
+		{"flagOpenOpenings", nil},
+		{"migrateIndex", nil},
+		{"decommissionBin", []string{"b1"}},
+	}
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	for _, tt := range tests {
+		for _, role := range []string{"", "producer"} {
+			if err := net.invoke("alice", role, tt.function, tt.args...); err == nil {
+				t.Errorf("%s with role %q succeeded", tt.function, role)
+			}
+		}
+		if err := net.invoke("root", roleAdmin, tt.function, tt.args...); err != nil {
+			t.Errorf("%s as admin: %v", tt.function, err)
+		}
+	}
+}
+
+func TestOpeningLocation(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("root", roleAdmin, "relocateBin", "b1", "46", "10")
+	// the first opening is recorded after the move but dated before it
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748801500")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748802500")
+
+	tests := []struct {
+		id       string
+		lat, lng float64
+	}{
+		{"1", 45, 9},
+		{"2", 46, 10},
+	}
+	for _, tt := range tests {
+		openbin := net.opening(tt.id)
+		if openbin.BinId != "b1" || openbin.Lat != tt.lat || openbin.Lng != tt.lng {
+			t.Errorf("opening %s = %s at %v,%v; want b1 at %v,%v", tt.id, openbin.BinId, openbin.Lat, openbin.Lng, tt.lat, tt.lng)
+		}
+	}
+}
+
+func TestOpeningBinLifetime(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("root", roleAdmin, "decommissionBin", "b1")
+
+	tests := []struct {
+		open string
+		ok   bool
+	}{
+		{"1476748800500", false}, // before registration
+		{"1476748801000", true},  // registered
+		{"1476748801500", true},  // before decommissioning
+		{"1476748802000", false}, // decommissioned
+	}
+	for _, tt := range tests {
+		err := net.invoke("alice", "", "newOpening", "b1", tt.open)
+		if (err == nil) != tt.ok {
+			t.Errorf("newOpening at %s: err = %v, want ok %v", tt.open, err, tt.ok)
+		}
+	}
+	if err := net.invoke("alice", "", "newOpening", "b2", "1476748801000"); err == nil {
+		t.Error("newOpening of an unregistered bin succeeded")
+	}
+}
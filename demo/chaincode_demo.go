@@ -20,23 +20,29 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
-	"time"
 	"encoding/json"
 	"encoding/binary"
+	"math"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/statekey"
+	"github.com/iorfix/learn-chaincode/txclock"
 )
 
 type OpenBinObj struct {
 	Id				  uint32	`json:"id"` 
 	Producer          string	`json:"producer"`
-	Lat				  float64	`json:"lat"`
+	BinId			  string	`json:"binId"`	//empty for openings recorded before the bin registry
+	Lat				  float64	`json:"lat"`	//where the bin stood when it was opened
 	Lng				  float64	`json:"lng"`
 	TimestampOpened	  int64	`json:"timestampOpened"`	//utc timestamp of creation
 	TimestampClosed	  int64	`json:"timestampClosed"`
+	Anomalies		  []Anomaly	`json:"anomalies,omitempty"`	//suspicious patterns the opening matched
 }
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
+	clock txclock.Clock	// nil means the transaction timestamp
 }
 
 func main() {
@@ -58,33 +64,63 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 		return nil, err2
 	}
 	err := stub.PutState("USERLIST", usersByte)
-	return nil, err
+	if (err != nil) {
+		return nil, err
+	}
+	// a new deployment has no legacy opening chains to migrate
+	err = markMigrated(stub)
+	if (err != nil) {
+		return nil, err
+	}
+	return nil, identity.Init(stub, args)
 }
 
 
 // Invoke isur entry point to invoke a chaincode function
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
-	caller, er := stub.GetPayload()
+	payload, er := stub.GetPayload()
 	if (er !=nil) {
 		fmt.Println(er)
 	}
-	fmt.Println("GetPayload: ", caller)
-	
-
-	//user, err := t.get_username(stub)
-	//user := "PIPPO"
-	
-	//fmt.Println("username: " + user)
+	fmt.Println("GetPayload: ", payload)
 	
 	// Handle different functions
+	// Init empties USERLIST and resets dev mode, so it only runs when deploying
 	if function == "init" {
-		return t.Init(stub, "init", args)
-	} else if function == "newOpening" {
-		return t.newOpening(stub, args)
-//	} else if function == "collect" {
-//		user := "COLL"
-//		return t.collectWaste(stub, user, args)
+		return nil, errors.New("init can only run when deploying")
+	} else if function == "setDevCaller" {
+		return t.setDevCaller(stub, args)
+	}
+
+	caller, err := identity.Read(stub)
+	if (err != nil) {
+		return nil, err
+	}
+	fmt.Println("username: " + caller.User)
+
+	if function == "newOpening" {
+		return t.newOpening(stub, caller, args)
+	} else if function == "closeOpening" {
+		return t.closeOpening(stub, caller, args)
+	} else if function == "migrateIndex" {
+		return t.migrateIndex(stub, caller, args)
+	} else if function == "registerBin" {
+		return t.registerBin(stub, caller, args)
+	} else if function == "relocateBin" {
+		return t.relocateBin(stub, caller, args)
+	} else if function == "decommissionBin" {
+		return t.decommissionBin(stub, caller, args)
+	} else if function == "setTariff" {
+		return t.setTariff(stub, caller, args)
+	} else if function == "removeTariff" {
+		return t.removeTariff(stub, caller, args)
+	} else if function == "freezeInvoice" {
+		return t.freezeInvoice(stub, caller, args)
+	} else if function == "setAnomalyRules" {
+		return t.setAnomalyRules(stub, caller, args)
+	} else if function == "flagOpenOpenings" {
+		return t.flagOpenOpenings(stub, caller, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
 
@@ -96,82 +132,291 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	fmt.Println("query is running " + function) 
 	fmt.Println(args)
 	// Handle different functions
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting key")
-	}
-	key := args[0]
-	fmt.Println("readkey:", key)
 	var byteVal []byte
 	var err error
 	if (function == "readalluser") {
-		byteVal, err = readAllFromUser(stub, key)
+		byteVal, err = readAllFromUser(stub, args)
 	} else if (function == "readall") {
-		byteVal, err = readAll(stub)
+		byteVal, err = readAll(stub, args)
+	} else if (function == "readbbox") {
+		byteVal, err = readBbox(stub, args)
+	} else if (function == "readradius") {
+		byteVal, err = readRadius(stub, args)
+	} else if (function == "readrange") {
+		byteVal, err = readRange(stub, args)
+	} else if (function == "readopen") {
+		byteVal, err = readOpen(stub, args)
+	} else if (function == "readbins") {
+		byteVal, err = readBins(stub, args)
+	} else if (function == "bill") {
+		byteVal, err = readBill(stub, args)
+	} else if (function == "readtariffs") {
+		byteVal, err = readTariffTable(stub, args)
+	} else if (function == "anomalies") {
+		byteVal, err = readAnomalies(stub, args)
+	} else if (function == "readanomalyrules") {
+		byteVal, err = readAnomalyRuleTable(stub, args)
+	} else if (function == "readinvoices") {
+		byteVal, err = readProducerInvoices(stub, args)
 	} else {
-		byteVal, err = readKeyState(stub, key)
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting key")
+		}
+		key := args[0]
+		fmt.Println("readkey:", key)
+		if (function == "readopening") {
+			byteVal, err = readOpeningById(stub, key)
+		} else if (function == "readbin") {
+			byteVal, err = readBinById(stub, key)
+		} else {
+			// raw state holds invoices, tariffs and dev mode settings, so
+			// it is only read through the queries above
+			return nil, errors.New("Received unknown function query: " + function)
+		}
 	}
 	
 	fmt.Println("reading:", byteVal)
 	return byteVal, err
 }
 
-func (t *SimpleChaincode) newOpening(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// newOpening records an opening of a registered bin by the caller: bin, open and optionally close
+func (t *SimpleChaincode) newOpening(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
 	fmt.Println("Opening:",  args)
-		if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting user, lat, lng, open, close")
+		if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting bin, open and optionally close")
 	}
-	user := args[0]
-	var chainuserarray []byte
-	var err error
-	var id uint32
-	var openbin OpenBinObj
-	chainuserarray, err = readChain (stub, user);
+	now, err := t.now(stub)
+	if (err != nil) {
+		return nil, err
+	}
+	// nothing may be written until every argument has been checked
+	bin, err := openableBin(stub, args[0])
+	if (err != nil) {
+		return nil, err
+	}
+	openbin, err := parseOpening(caller.User, bin, args[1:], now)
+	if (err != nil) {
+		return nil, err
+	}
+	invoiced, err := invoicedAt(stub, openbin.Producer, openbin.TimestampOpened, openbin.TimestampOpened+1)
+	if (err != nil) {
+		return nil, err
+	}
+	if (invoiced) {
+		return nil, invalid("open", "falls in a period that has already been invoiced")
+	}
+	// suspicious openings are flagged, not rejected
+	prev, err := checkOpening(stub, &openbin, now)
+	if (err != nil) {
+		return nil, err
+	}
+	user := openbin.Producer
+	known, err := producerKnown(stub, user)
 	if (err != nil) {
 		return nil, err
 	}
-	if (chainuserarray == nil) {
-		chainuserarray = make([]byte, 0)
+	if (!known) {
 		erradd := addnewuser(stub, user)
 		if (erradd !=nil) {
 			return nil, erradd
 		}
 	}
-	fmt.Println("prev chainuserarray", chainuserarray )
-	id = makeTimestamp()
-	idByteArr := make([]byte, 4)
-	idS := strconv.FormatUint(uint64(id), 10)
-    binary.LittleEndian.PutUint32(idByteArr, id)
-	chainuserarray = append(chainuserarray, idByteArr...)
-	fmt.Println("new chainuserarray", chainuserarray)
-	err = writeUserChain(stub, user, chainuserarray)
-	
-	openbin.Id = id
-	openbin.Producer = user
-	openbin.Lat, err = strconv.ParseFloat(args[1], 64)
-	if (err !=nil) {
+	openbin.Id, err = nextOpeningId(stub)
+	if (err != nil) {
 		return nil, err
 	}
-	openbin.Lng, err = strconv.ParseFloat(args[2], 64)
-	if (err !=nil) {
+	err = indexOpening(stub, user, openbin.Id)
+	if (err != nil) {
 		return nil, err
 	}
-	openbin.TimestampOpened, err = strconv.ParseInt(args[3], 10, 64)
-	if (err !=nil) {
+	err = indexOpeningDetails(stub, &openbin)
+	if (err != nil) {
 		return nil, err
 	}
-	openbin.TimestampClosed, err = strconv.ParseInt(args[4], 10, 64)
-	if (err !=nil) {
+	err = createOpening(stub, &openbin)
+	if (err != nil) {
 		return nil, err
 	}
-	openBinByte, err2 := json.Marshal(openbin)
-	if (err2 !=nil) {
-		return nil, err2
+	return nil, checkPreviousOpening(stub, prev, now)
+}
+
+// setDevCaller chooses who the following transactions act as when deployed in dev mode: user, role
+func (t *SimpleChaincode) setDevCaller(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting user, role")
+	}
+	return nil, identity.SetDevCaller(stub, identity.Caller{User: args[0], Role: args[1]})
+}
+
+// roleAdmin is the role that maintains the chaincode
+const roleAdmin = "admin"
+
+// requireAdmin fails unless the caller holds the admin role
+func requireAdmin(caller identity.Caller, function string) error {
+	if caller.Role != roleAdmin {
+		return errors.New("{\"Error\":\"" + caller.User + " with role '" + caller.Role + "' may not call " + function + "\"}")
+	}
+	return nil
+}
+
+// requireAdminRead is requireAdmin for queries, which read their caller from the stub
+func requireAdminRead(stub shim.ChaincodeStubInterface, function string) error {
+	caller, err := identity.Read(stub)
+	if err != nil {
+		return err
+	}
+	return requireAdmin(caller, function)
+}
+
+// authorizeProducerRead lets producers read their own openings, bills and
+// invoices, and admins read everyone's. An empty producer stands for every
+// producer, which only admins may read.
+func authorizeProducerRead(stub shim.ChaincodeStubInterface, producer string) error {
+	caller, err := identity.Read(stub)
+	if err != nil {
+		return err
+	}
+	if caller.Role == roleAdmin || (producer != "" && caller.User == producer) {
+		return nil
+	}
+	if producer == "" {
+		return errors.New("{\"Error\":\"" + caller.User + " may not read the records of every producer\"}")
+	}
+	return errors.New("{\"Error\":\"" + caller.User + " may not read the records of " + producer + "\"}")
+}
+
+// ============================================================================================================================
+// Opening records - stored under the "opening" composite key. Records written before the composite key existed live
+// under their bare decimal ID; they are still resolved, and their IDs are never handed out again.
+// ============================================================================================================================
+func openingKey(id uint32) (string, error) {
+	return statekey.Create("opening", statekey.Uint(uint64(id)))
+}
+
+func legacyOpeningKey(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+func openingIdTaken(stub shim.ChaincodeStubInterface, id uint32) (bool, error) {
+	key, err := openingKey(id)
+	if (err != nil) {
+		return false, err
+	}
+	for _, k := range []string{key, legacyOpeningKey(id)} {
+		valAsbytes, err := stub.GetState(k)
+		if (err != nil) {
+			return false, err
+		}
+		if (len(valAsbytes) != 0) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nextOpeningId hands out opening IDs from a counter kept in state
+func nextOpeningId(stub shim.ChaincodeStubInterface) (uint32, error) {
+	seqKey, err := statekey.Create("sequence", "opening")
+	if (err != nil) {
+		return 0, err
+	}
+	valAsbytes, err := stub.GetState(seqKey)
+	if (err != nil) {
+		return 0, err
+	}
+	var last uint64
+	if (len(valAsbytes) != 0) {
+		last, err = strconv.ParseUint(string(valAsbytes), 10, 32)
+		if (err != nil) {
+			return 0, errors.New("Corrupt opening sequence: " + string(valAsbytes))
+		}
+	}
+	for {
+		if (last == math.MaxUint32) {
+			return 0, errors.New("Opening IDs exhausted")
+		}
+		last++
+		taken, err := openingIdTaken(stub, uint32(last))
+		if (err != nil) {
+			return 0, err
+		}
+		if (!taken) {
+			break
+		}
+	}
+	err = stub.PutState(seqKey, []byte(strconv.FormatUint(last, 10)))
+	return uint32(last), err
+}
+
+// createOpening stores a new opening, refusing to overwrite an existing one
+func createOpening(stub shim.ChaincodeStubInterface, openbin *OpenBinObj) (error) {
+	taken, err := openingIdTaken(stub, openbin.Id)
+	if (err != nil) {
+		return err
+	}
+	if (taken) {
+		return errors.New("Opening " + legacyOpeningKey(openbin.Id) + " already exists")
+	}
+	key, err := openingKey(openbin.Id)
+	if (err != nil) {
+		return err
+	}
+	return writeOpening(stub, key, openbin)
+}
+
+func writeOpening(stub shim.ChaincodeStubInterface, key string, openbin *OpenBinObj) (error) {
+	openBinByte, err := json.Marshal(openbin)
+	if (err != nil) {
+		return err
 	}
 	fmt.Println("Marshalled:" + string(openBinByte))
-	
-	err = stub.PutState(idS, openBinByte)
-	return nil, err
-	
+	return stub.PutState(key, openBinByte)
+}
+
+// findOpening looks an opening up under its composite key first and under its legacy bare ID second.
+// It returns nil if neither exists.
+func findOpening(stub shim.ChaincodeStubInterface, id uint32) (*OpenBinObj, error) {
+	openbin, _, err := locateOpening(stub, id)
+	return openbin, err
+}
+
+// locateOpening is findOpening that also returns the key the opening is stored under
+func locateOpening(stub shim.ChaincodeStubInterface, id uint32) (*OpenBinObj, string, error) {
+	key, err := openingKey(id)
+	if (err != nil) {
+		return nil, "", err
+	}
+	valAsbytes, err := readKeyState(stub, key)
+	if (err != nil) {
+		return nil, "", err
+	}
+	if (len(valAsbytes) == 0) {
+		key = legacyOpeningKey(id)
+		valAsbytes, err = readKeyState(stub, key)
+		if (err != nil) {
+			return nil, "", err
+		}
+	}
+	if (len(valAsbytes) == 0) {
+		return nil, "", nil
+	}
+	var openbin OpenBinObj
+	err = json.Unmarshal(valAsbytes, &openbin)
+	if (err != nil) {
+		return nil, "", errors.New("Corrupt opening record " + string(valAsbytes))
+	}
+	return &openbin, key, nil
+}
+
+func readOpening(stub shim.ChaincodeStubInterface, id uint32) (OpenBinObj, error) {
+	openbin, err := findOpening(stub, id)
+	if (err != nil) {
+		return OpenBinObj{}, err
+	}
+	if (openbin == nil) {
+		return OpenBinObj{}, errors.New("Opening " + legacyOpeningKey(id) + " not found")
+	}
+	return *openbin, nil
 }
 
 func addnewuser(stub shim.ChaincodeStubInterface, newuser string) (error) {
@@ -210,19 +455,12 @@ func readChain(stub shim.ChaincodeStubInterface, user string) ([]byte, error) {
 	return valAsbytes, err
 }
 
-func  writeUserChain(stub shim.ChaincodeStubInterface, user string, vals []byte) (error) {
-	err := stub.PutState(user, vals) //write the variable into the chaincode state
-	return err
-}
-
 
 // ============================================================================================================================
-// Make Timestamp - create a timestamp in ms
+// now - the transaction time in ms, identical on every peer
 // ============================================================================================================================
-func makeTimestamp() uint32 {
-	var now int64 
-	now = time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
-    return uint32(now)
+func (t *SimpleChaincode) now(stub shim.ChaincodeStubInterface) (int64, error) {
+	return txclock.Or(t.clock).Now(stub)
 }
 
 
@@ -237,43 +475,18 @@ func readKeyState(stub shim.ChaincodeStubInterface, key string) ([]byte, error)
 	return valAsbytes, err
 }
 
-func readAllFromUser(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
-	openBinArr, err := readAllFromUserObj(stub, key)
+func readOpeningById(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	id, err := strconv.ParseUint(key, 10, 32)
 	if (err != nil) {
-		return nil, err
+		return nil, errors.New("Invalid opening id: " + key)
 	}
-	wByte, err2 := json.Marshal(&openBinArr)
-	return wByte, err2
-
-}
-func readAllFromUserObj(stub shim.ChaincodeStubInterface, key string) ([]OpenBinObj, error) {
-
-	chainuserarray, err := readChain(stub, key)
-	if err != nil {
+	openbin, err := readOpening(stub, uint32(id))
+	if (err != nil) {
 		return nil, err
 	}
-
-	chainuserint := convertByteArrayToUint32Array(&chainuserarray)
-	fmt.Println(chainuserint)
-	numElems := len(chainuserint)
-	openBinArr := make([]OpenBinObj, numElems)
-	for i := 0; i < numElems; i++ {
-		idConf :=  strconv.FormatUint(uint64(chainuserint[i]),10)
-		valAsbytes, err := readKeyState(stub, idConf)
-		if (err !=nil) {
-			fmt.Println("error reading:", idConf)
-			return nil, err
-		}
-		err = json.Unmarshal(valAsbytes, &openBinArr[i]);
-		fmt.Println("Read:", openBinArr[i])
-	}
-	fmt.Println("Fullread:", openBinArr)
-	return openBinArr, nil
+	return json.Marshal(&openbin)
 }
 
-
-
-
 func convertByteArrayToUint32Array(bytearray *[]byte) []uint32 {
 	numElems := len(*bytearray)/4
 	uintarray := make([]uint32, numElems)
@@ -285,24 +498,3 @@ func convertByteArrayToUint32Array(bytearray *[]byte) []uint32 {
 	fmt.Println(uintarray)
 	return uintarray
 }
-
-func readAll(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	userlist, err := readUserList(stub)
-	if (err!=nil) {
-		return nil, err
-	}
-	numUsers := len(userlist)
-	openBinArr := make([]OpenBinObj, 0)
-	for i := 0; i<numUsers; i++ {
-		openUsrArr, err2 := readAllFromUserObj(stub, userlist[i])
-		if (err2!=nil) {
-			return nil, err2
-		}
-		openBinArr = append(openBinArr, openUsrArr...)
-	}
-	fmt.Println("Read:", openBinArr)
-	wByte, err2 := json.Marshal(&openBinArr)
-	return wByte, err2
-}
-
-
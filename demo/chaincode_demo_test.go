@@ -0,0 +1,168 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/mockstub"
+	"github.com/iorfix/learn-chaincode/txclock"
+)
+
+const deployedAt = 1476748800000
+
+// testNet is a chaincode deployed on a mock stub
+type testNet struct {
+	t    *testing.T
+	cc   *SimpleChaincode
+	stub *mockstub.Stub
+}
+
+func deploy(t *testing.T, cc *SimpleChaincode, arg string) *testNet {
+	stub := mockstub.New()
+	stub.Timestamp = deployedAt
+	if _, err := cc.Init(stub, "init", []string{arg}); err != nil {
+		t.Fatal(err)
+	}
+	return &testNet{t: t, cc: cc, stub: stub}
+}
+
+// invoke runs function as user with role, one second after the previous transaction
+func (n *testNet) invoke(user string, role string, function string, args ...string) error {
+	n.stub.SetCaller(user, role)
+	n.stub.TxID = function
+	n.stub.Timestamp += 1000
+	_, err := n.cc.Invoke(n.stub, function, args)
+	return err
+}
+
+func (n *testNet) mustInvoke(user string, role string, function string, args ...string) {
+	if err := n.invoke(user, role, function, args...); err != nil {
+		n.t.Fatalf("%s %v: %v", function, args, err)
+	}
+}
+
+func (n *testNet) query(user string, role string, function string, args ...string) ([]byte, error) {
+	n.stub.SetCaller(user, role)
+	return n.cc.Query(n.stub, function, args)
+}
+
+func (n *testNet) opening(id string) OpenBinObj {
+	val, err := n.query("", "", "readopening", id)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	var openbin OpenBinObj
+	if err := json.Unmarshal(val, &openbin); err != nil {
+		n.t.Fatal(err)
+	}
+	return openbin
+}
+
+func TestInitOnlyOnDeploy(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748801000")
+	for _, role := range []string{roleAdmin, ""} {
+		if err := net.invoke("mallory", role, "init", "0"); err == nil {
+			t.Errorf("init invoked with role %q succeeded", role)
+		}
+	}
+	users, err := readUserList(net.stub)
+	if err != nil || len(users) != 1 || users[0] != "alice" {
+		t.Errorf("USERLIST = %v, %v; want [alice]", users, err)
+	}
+}
+
+func TestDevCaller(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	if err := net.invoke("alice", "", "setDevCaller", "root", roleAdmin); err == nil {
+		t.Fatal("setDevCaller succeeded without dev mode")
+	}
+
+	net = deploy(t, new(SimpleChaincode), identity.DevModeArg)
+	net.mustInvoke("", "", "setDevCaller", "root", roleAdmin)
+	net.mustInvoke("", "", "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("", "", "setDevCaller", "alice", "")
+	// certificates are ignored in dev mode
+	net.mustInvoke("bob", roleAdmin, "newOpening", "b1", "1476748802000")
+	if producer := net.opening("1").Producer; producer != "alice" {
+		t.Errorf("Producer = %q, want alice", producer)
+	}
+}
+
+func TestCloseOpeningOwner(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748801000")
+	if err := net.invoke("bob", "", "closeOpening", "1", "1476748805000"); err == nil {
+		t.Error("closeOpening by another producer succeeded")
+	}
+	net.mustInvoke("alice", "", "closeOpening", "1", "1476748805000")
+}
+
+func TestOpeningTimestamps(t *testing.T) {
+	// a day after the transaction timestamps, so only the clock can produce it
+	const now = deployedAt + 24*60*60*1000
+	net := deploy(t, &SimpleChaincode{clock: txclock.Fixed(now)}, "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	bin, err := readBin(net.stub, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin.TimestampRegistered != now {
+		t.Errorf("TimestampRegistered = %d, want %d", bin.TimestampRegistered, int64(now))
+	}
+
+	tests := []struct {
+		open    int64
+		close   int64
+		wantErr bool
+	}{
+		{now, now + 5000, false},
+		{now + maxClockSkew, 0, false},
+		{now + maxClockSkew + 1, 0, true},
+		{now, now + maxClockSkew + 1, true},
+	}
+	for _, tt := range tests {
+		args := []string{"b1", strconv.FormatInt(tt.open, 10)}
+		if tt.close != 0 {
+			args = append(args, strconv.FormatInt(tt.close, 10))
+		}
+		err := net.invoke("alice", "", "newOpening", args...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newOpening %v: error = %v, wantErr %v", args[1:], err, tt.wantErr)
+		}
+	}
+	openbin := net.opening("1")
+	if openbin.TimestampOpened != now || openbin.TimestampClosed != now+5000 {
+		t.Errorf("opening 1 = %+v, want opened %d and closed %d", openbin, int64(now), int64(now+5000))
+	}
+}
+
+func TestMigrateIndexNeedsAdmin(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	for _, role := range []string{"", "producer"} {
+		if err := net.invoke("alice", role, "migrateIndex"); err == nil {
+			t.Errorf("migrateIndex with role %q succeeded", role)
+		}
+	}
+	net.mustInvoke("root", roleAdmin, "migrateIndex")
+}
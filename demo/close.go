@@ -0,0 +1,108 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// An opening whose TimestampClosed is 0 is still open. Open openings are
+// listed under opening~open/<id> until closeOpening removes them.
+const openIndex = "opening~open"
+
+func openKey(id uint32) (string, error) {
+	return statekey.Create(openIndex, statekey.Uint(uint64(id)))
+}
+
+// closeOpening records when a bin lid was closed: id, timestampClosed. Only
+// the producer who made the opening may close it.
+func (t *SimpleChaincode) closeOpening(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, close")
+	}
+	id, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return nil, invalid("id", "not an opening id")
+	}
+	openbin, key, err := locateOpening(stub, uint32(id))
+	if err != nil {
+		return nil, err
+	}
+	if openbin == nil {
+		return nil, errors.New("Opening " + args[0] + " not found")
+	}
+	if openbin.Producer != caller.User {
+		return nil, errors.New("Opening " + args[0] + " belongs to another producer")
+	}
+	if openbin.TimestampClosed != 0 {
+		return nil, errors.New("Opening " + args[0] + " is already closed")
+	}
+	now, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	closed, err := parseClose(args[1], openbin.TimestampOpened, now)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := readAnomalyRules(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	openbin.TimestampClosed = closed
+	checkOpenDuration(&rules, openbin, now)
+	err = writeOpening(stub, key, openbin)
+	if err != nil {
+		return nil, err
+	}
+	err = indexAnomalies(stub, openbin)
+	if err != nil {
+		return nil, err
+	}
+	key, err = openKey(openbin.Id)
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.DelState(key)
+}
+
+// readOpen pages through the openings that have not been closed yet, ordered
+// by ID: pageSize, cursor
+func readOpen(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	pageSize, cursor, err := pager.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := statekey.PrefixRange(openIndex)
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageOpenings(stub, start, end, pageSize, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
@@ -0,0 +1,308 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Openings are indexed by the geohash of where they happened,
+// opening~geo/<geohash>/<id>. Nearby points share a geohash prefix, so an
+// area query turns into a handful of prefix range scans instead of a full
+// scan of every opening.
+const (
+	geoIndex       = "opening~geo"
+	geohashLength  = 9  // cells of roughly 5m x 5m
+	maxCoverCells  = 32 // most prefix scans a single area query may issue
+	maxAreaResults = pager.MaxSize
+	earthRadius    = 6371000.0 // metres
+	metresPerDeg   = 111320.0  // length of one degree of latitude
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a point as a geohash of the given length
+func geohash(lat float64, lng float64, length int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+	hash := make([]byte, 0, length)
+	bit, ch, even := 0, 0, true
+	for len(hash) < length {
+		if even {
+			mid := (minLng + maxLng) / 2
+			if lng >= mid {
+				ch = ch<<1 | 1
+				minLng = mid
+			} else {
+				ch = ch << 1
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch = ch << 1
+				maxLat = mid
+			}
+		}
+		even = !even
+		bit++
+		if bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// geohashCell returns the height and width in degrees of a geohash cell
+func geohashCell(length int) (float64, float64) {
+	bits := uint(5 * length)
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / float64(uint64(1)<<latBits), 360 / float64(uint64(1)<<lngBits)
+}
+
+func geoKey(openbin *OpenBinObj) (string, error) {
+	return statekey.Create(geoIndex, geohash(openbin.Lat, openbin.Lng, geohashLength), statekey.Uint(uint64(openbin.Id)))
+}
+
+// box is a latitude/longitude rectangle that does not cross the antimeridian
+type box struct {
+	minLat, minLng, maxLat, maxLng float64
+}
+
+func (b box) contains(lat float64, lng float64) bool {
+	return lat >= b.minLat && lat <= b.maxLat && lng >= b.minLng && lng <= b.maxLng
+}
+
+// splitBox turns a rectangle into boxes that do not cross the antimeridian.
+// minLng greater than maxLng means the rectangle wraps around it.
+func splitBox(minLat float64, minLng float64, maxLat float64, maxLng float64) []box {
+	if minLng <= maxLng {
+		return []box{{minLat, minLng, maxLat, maxLng}}
+	}
+	return []box{{minLat, minLng, maxLat, 180}, {minLat, -180, maxLat, maxLng}}
+}
+
+// coverBoxes returns the geohash prefixes that together cover boxes, using
+// the longest prefix that keeps the number of cells within maxCoverCells
+func coverBoxes(boxes []box) []string {
+	for length := geohashLength; length > 1; length-- {
+		if cells, ok := cellsCovering(boxes, length); ok {
+			return cells
+		}
+	}
+	cells, _ := cellsCovering(boxes, 1) // 32 cells cover the whole globe
+	return cells
+}
+
+// cellsCovering lists the cells of the given length that overlap boxes, or
+// reports false if there are more than maxCoverCells of them
+func cellsCovering(boxes []box, length int) ([]string, bool) {
+	height, width := geohashCell(length)
+	total := int64(0)
+	for _, b := range boxes {
+		rows := cellIndex(b.maxLat+90, height, 180) - cellIndex(b.minLat+90, height, 180) + 1
+		cols := cellIndex(b.maxLng+180, width, 360) - cellIndex(b.minLng+180, width, 360) + 1
+		total += rows * cols
+	}
+	if total > maxCoverCells {
+		return nil, false
+	}
+
+	seen := make(map[string]bool)
+	cells := make([]string, 0, total)
+	for _, b := range boxes {
+		for row := cellIndex(b.minLat+90, height, 180); row <= cellIndex(b.maxLat+90, height, 180); row++ {
+			for col := cellIndex(b.minLng+180, width, 360); col <= cellIndex(b.maxLng+180, width, 360); col++ {
+				lat := -90 + (float64(row)+0.5)*height
+				lng := -180 + (float64(col)+0.5)*width
+				cell := geohash(lat, lng, length)
+				if !seen[cell] {
+					seen[cell] = true
+					cells = append(cells, cell)
+				}
+			}
+		}
+	}
+	sort.Strings(cells)
+	return cells, true
+}
+
+// cellIndex returns which cell of the given size an offset into span falls in
+func cellIndex(offset float64, size float64, span float64) int64 {
+	i := int64(math.Floor(offset / size))
+	if last := int64(math.Ceil(span/size)) - 1; i > last {
+		i = last // the north pole and the antimeridian belong to the last cell
+	}
+	return i
+}
+
+// openingsInBoxes scans the geohash index for the cells covering boxes and
+// returns the openings accepted by keep, ordered by ID
+func openingsInBoxes(stub shim.ChaincodeStubInterface, boxes []box, keep func(*OpenBinObj) bool) ([]OpenBinObj, error) {
+	openBinArr := make([]OpenBinObj, 0)
+	for _, cell := range coverBoxes(boxes) {
+		start, end, err := statekey.PartialRange(geoIndex, nil, cell)
+		if err != nil {
+			return nil, err
+		}
+		iter, err := stub.RangeQueryState(start, end)
+		if err != nil {
+			return nil, err
+		}
+		for iter.HasNext() {
+			key, _, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			id, err := openingIdFromIndexKey(key)
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			openbin, err := findOpening(stub, id)
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			if openbin == nil || !keep(openbin) {
+				continue
+			}
+			if len(openBinArr) == maxAreaResults {
+				iter.Close()
+				return nil, fmt.Errorf("More than %d openings in the area. Narrow the search", maxAreaResults)
+			}
+			openBinArr = append(openBinArr, *openbin)
+		}
+		iter.Close()
+	}
+	sort.Sort(openingsById(openBinArr))
+	return openBinArr, nil
+}
+
+type openingsById []OpenBinObj
+
+func (o openingsById) Len() int           { return len(o) }
+func (o openingsById) Less(i, j int) bool { return o[i].Id < o[j].Id }
+func (o openingsById) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// readBbox returns the openings inside a rectangle: minLat, minLng, maxLat, maxLng.
+// A minLng greater than maxLng selects a rectangle crossing the antimeridian.
+func readBbox(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting minLat, minLng, maxLat, maxLng")
+	}
+	minLat, err := parseLatLng("minLat", args[0], 90)
+	if err != nil {
+		return nil, err
+	}
+	minLng, err := parseLatLng("minLng", args[1], 180)
+	if err != nil {
+		return nil, err
+	}
+	maxLat, err := parseLatLng("maxLat", args[2], 90)
+	if err != nil {
+		return nil, err
+	}
+	maxLng, err := parseLatLng("maxLng", args[3], 180)
+	if err != nil {
+		return nil, err
+	}
+	if minLat > maxLat {
+		return nil, invalid("maxLat", "must not be less than minLat")
+	}
+	boxes := splitBox(minLat, minLng, maxLat, maxLng)
+	openBinArr, err := openingsInBoxes(stub, boxes, func(openbin *OpenBinObj) bool {
+		for _, b := range boxes {
+			if b.contains(openbin.Lat, openbin.Lng) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&openBinArr)
+}
+
+// readRadius returns the openings within a distance of a point: lat, lng, metres
+func readRadius(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lat, lng, metres")
+	}
+	lat, err := parseLatLng("lat", args[0], 90)
+	if err != nil {
+		return nil, err
+	}
+	lng, err := parseLatLng("lng", args[1], 180)
+	if err != nil {
+		return nil, err
+	}
+	metres, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || !(metres > 0) || metres > math.Pi*earthRadius {
+		return nil, invalid("metres", "must be a positive distance")
+	}
+
+	dLat := metres / metresPerDeg
+	minLat, maxLat := math.Max(lat-dLat, -90), math.Min(lat+dLat, 90)
+	var boxes []box
+	cos := math.Cos(math.Max(math.Abs(minLat), math.Abs(maxLat)) * math.Pi / 180)
+	if dLng := dLat / cos; cos <= 0 || dLng >= 180 {
+		boxes = []box{{minLat, -180, maxLat, 180}}
+	} else {
+		minLng, maxLng := lng-dLng, lng+dLng
+		if minLng < -180 {
+			minLng += 360
+		}
+		if maxLng > 180 {
+			maxLng -= 360
+		}
+		boxes = splitBox(minLat, minLng, maxLat, maxLng)
+	}
+	openBinArr, err := openingsInBoxes(stub, boxes, func(openbin *OpenBinObj) bool {
+		return distance(lat, lng, openbin.Lat, openbin.Lng) <= metres
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&openBinArr)
+}
+
+// distance returns the great-circle distance in metres between two points
+func distance(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,299 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Each opening a producer makes is recorded as its own key,
+// producer~opening/<producer>/<id>, so adding an opening is a single small
+// write and a producer's openings are one range scan. Producers used to keep
+// a packed little-endian blob of IDs under their bare name; those blobs are
+// still read until migrateIndex converts them.
+const producerOpeningIndex = "producer~opening"
+
+func producerOpeningKey(producer string, id uint32) (string, error) {
+	return statekey.Create(producerOpeningIndex, producer, statekey.Uint(uint64(id)))
+}
+
+func indexOpening(stub shim.ChaincodeStubInterface, producer string, id uint32) error {
+	key, err := producerOpeningKey(producer, id)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, statekey.IndexValue)
+}
+
+// indexOpeningDetails writes the secondary indexes derived from an opening's
+// contents. Rewriting them for an opening that is already indexed is harmless.
+func indexOpeningDetails(stub shim.ChaincodeStubInterface, openbin *OpenBinObj) error {
+	key, err := geoKey(openbin)
+	if err != nil {
+		return err
+	}
+	keys, err := timeKeys(openbin)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, key)
+	flagged, err := anomalyKeys(openbin)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, flagged...)
+	if openbin.TimestampClosed == 0 {
+		key, err = openKey(openbin.Id)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	for _, k := range keys {
+		err = stub.PutState(k, statekey.IndexValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openingIdFromIndexKey returns the opening ID, which is always the last
+// attribute of an opening index key
+func openingIdFromIndexKey(key string) (uint32, error) {
+	_, attrs, err := statekey.Split(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(attrs) == 0 {
+		return 0, errors.New("Corrupt index key " + key)
+	}
+	id, err := strconv.ParseUint(attrs[len(attrs)-1], 10, 32)
+	if err != nil {
+		return 0, errors.New("Corrupt index key " + key)
+	}
+	return uint32(id), nil
+}
+
+// legacyChainIds returns the IDs in a producer's pre-index blob, if any. The
+// blob packs 4 bytes per ID. A producer whose name is also a bare opening ID
+// shares its key with that opening's legacy record, which is recognised by
+// holding the opening with that ID.
+func legacyChainIds(stub shim.ChaincodeStubInterface, producer string) ([]uint32, error) {
+	chainuserarray, err := readChain(stub, producer)
+	if err != nil {
+		return nil, err
+	}
+	if len(chainuserarray) == 0 {
+		return nil, nil
+	}
+	if id, err := strconv.ParseUint(producer, 10, 32); err == nil && legacyOpeningKey(uint32(id)) == producer {
+		var openbin OpenBinObj
+		if json.Unmarshal(chainuserarray, &openbin) == nil && openbin.Id == uint32(id) {
+			return nil, nil
+		}
+	}
+	if len(chainuserarray)%4 != 0 {
+		return nil, errors.New("Corrupt legacy opening chain for producer " + producer)
+	}
+	return convertByteArrayToUint32Array(&chainuserarray), nil
+}
+
+func producerKnown(stub shim.ChaincodeStubInterface, producer string) (bool, error) {
+	legacy, err := legacyChainIds(stub, producer)
+	if err != nil {
+		return false, err
+	}
+	if len(legacy) != 0 {
+		return true, nil
+	}
+	start, end, err := statekey.PrefixRange(producerOpeningIndex, producer)
+	if err != nil {
+		return false, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	return iter.HasNext(), nil
+}
+
+// migrateIndex converts legacy blobs into index keys and deletes them, and
+// (re)writes the secondary indexes of the producers' openings so that
+// openings made before an index existed are covered too: pageSize. Each run
+// handles the next pageSize producers in USERLIST order, resuming where the
+// previous run stopped, so a large ledger is migrated over several
+// transactions; after the last producer the next run starts over. It is
+// safe to run more than once. Only admins may run it.
+func (t *SimpleChaincode) migrateIndex(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	err := requireAdmin(caller, "migrateIndex")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pageSize")
+	}
+	pageSize, _, err := pager.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	userlist, err := readUserList(stub)
+	if err != nil {
+		return nil, err
+	}
+	cursorKey, err := migrateCursorKey()
+	if err != nil {
+		return nil, err
+	}
+	from, err := readMigrateCursor(stub, cursorKey, len(userlist))
+	if err != nil {
+		return nil, err
+	}
+	to := from + pageSize
+	if to > len(userlist) {
+		to = len(userlist)
+	}
+	for _, user := range userlist[from:to] {
+		err = migrateProducer(stub, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fmt.Println("migrated producers:", from, "to", to, "of", len(userlist))
+	if to == len(userlist) {
+		err = markMigrated(stub)
+		if err != nil {
+			return nil, err
+		}
+		return nil, stub.DelState(cursorKey)
+	}
+	return nil, stub.PutState(cursorKey, []byte(strconv.Itoa(to)))
+}
+
+// migratedKey is set once no producer has a legacy chain left: when the
+// chaincode is deployed, and when migrateIndex has been through USERLIST
+func migratedKey() (string, error) {
+	return statekey.Create("config", "migrated")
+}
+
+func markMigrated(stub shim.ChaincodeStubInterface) error {
+	key, err := migratedKey()
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte("true"))
+}
+
+// requireMigrated fails until no producer has a legacy chain left, so that
+// the producer~opening index covers every opening
+func requireMigrated(stub shim.ChaincodeStubInterface) error {
+	key, err := migratedKey()
+	if err != nil {
+		return err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if len(val) == 0 {
+		return errors.New("Some producers still have a legacy opening chain. Invoke migrateIndex until it has been through every producer")
+	}
+	return nil
+}
+
+// migrateCursorKey holds the USERLIST position the next migrateIndex run
+// starts at. USERLIST only grows, so positions stay valid between runs.
+func migrateCursorKey() (string, error) {
+	return statekey.Create("config", "migrateCursor")
+}
+
+func readMigrateCursor(stub shim.ChaincodeStubInterface, key string, users int) (int, error) {
+	val, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) == 0 {
+		return 0, nil
+	}
+	from, err := strconv.Atoi(string(val))
+	if err != nil || from < 0 || from > users {
+		return 0, errors.New("Corrupt migration cursor " + string(val))
+	}
+	return from, nil
+}
+
+// migrateProducer moves a producer's legacy blob, if any, into index keys
+// and rewrites the secondary indexes of the producer's openings
+func migrateProducer(stub shim.ChaincodeStubInterface, producer string) error {
+	ids, err := legacyChainIds(stub, producer)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = indexOpening(stub, producer, id)
+		if err != nil {
+			return err
+		}
+	}
+	if ids != nil {
+		err = stub.DelState(producer)
+		if err != nil {
+			return err
+		}
+	}
+
+	start, end, err := statekey.PrefixRange(producerOpeningIndex, producer)
+	if err != nil {
+		return err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		id, err := openingIdFromIndexKey(key)
+		if err != nil {
+			return err
+		}
+		openbin, err := findOpening(stub, id)
+		if err != nil {
+			return err
+		}
+		if openbin == nil {
+			continue
+		}
+		err = indexOpeningDetails(stub, openbin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/iorfix/learn-chaincode/mockstub"
+)
+
+func TestLegacyChainIds(t *testing.T) {
+	tests := []struct {
+		producer string
+		val      string
+		want     []uint32
+		fails    bool
+	}{
+		{"alice", "", nil, false},
+		{"alice", "\x01\x00\x00\x00\x7b\x00\x00\x00", []uint32{1, 123}, false},
+		// a blob that happens to look like JSON is still a blob
+		{"alice", "{}  ", []uint32{0x20207d7b}, false},
+		// producer 7 shares its key with the legacy record of opening 7
+		{"7", `{"id":7,"producer":"bob"}`, nil, false},
+		{"7", "\x07\x00\x00\x00", []uint32{7}, false},
+		{"alice", "\x01\x00\x00", nil, true},
+	}
+	for _, tt := range tests {
+		stub := mockstub.New()
+		stub.State[tt.producer] = []byte(tt.val)
+		ids, err := legacyChainIds(stub, tt.producer)
+		if (err != nil) != tt.fails || !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("legacyChainIds(%q) with %q = %v, %v; want %v, fails %v", tt.producer, tt.val, ids, err, tt.want, tt.fails)
+		}
+	}
+}
+
+// legacyNet is a deployment holding openings 1 and 2 of alice and bob in the
+// pre-index layout, and a producer carol without openings
+func legacyNet(t *testing.T) *testNet {
+	net := deploy(t, new(SimpleChaincode), "0")
+	key, err := migratedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(net.stub.State, key)
+	net.stub.State["USERLIST"] = []byte(`["alice","bob","carol"]`)
+	net.stub.State["alice"] = []byte("\x01\x00\x00\x00")
+	net.stub.State["bob"] = []byte("\x02\x00\x00\x00")
+	net.stub.State["1"] = []byte(`{"id":1,"producer":"alice","lat":45,"lng":9,"timestampOpened":1476748700000}`)
+	net.stub.State["2"] = []byte(`{"id":2,"producer":"bob","lat":45,"lng":9,"timestampOpened":1476748700000}`)
+	return net
+}
+
+func TestMigrateIndexInBatches(t *testing.T) {
+	net := legacyNet(t)
+	cursorKey, err := migrateCursorKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.query("root", roleAdmin, "readall"); err == nil {
+		t.Error("readall succeeded before the migration")
+	}
+	net.mustInvoke("root", roleAdmin, "migrateIndex", "1")
+	if net.stub.State["alice"] != nil || net.stub.State["bob"] == nil {
+		t.Fatal("first run did not migrate alice alone")
+	}
+	if cursor := string(net.stub.State[cursorKey]); cursor != "1" {
+		t.Fatalf("cursor after first run = %q, want 1", cursor)
+	}
+	if _, err := net.query("root", roleAdmin, "readall"); err == nil {
+		t.Error("readall succeeded part way through the migration")
+	}
+	net.mustInvoke("root", roleAdmin, "migrateIndex", "2")
+	if net.stub.State["bob"] != nil || net.stub.State[cursorKey] != nil {
+		t.Fatal("second run did not finish the migration")
+	}
+	if _, err := net.query("root", roleAdmin, "readall"); err != nil {
+		t.Errorf("readall after the migration: %v", err)
+	}
+
+	val, err := net.query("bob", "", "readalluser", "bob", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page OpeningPage
+	if err := json.Unmarshal(val, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Id != 2 {
+		t.Errorf("bob's openings = %+v, want opening 2", page.Items)
+	}
+	// a later run starts over and changes nothing
+	net.mustInvoke("root", roleAdmin, "migrateIndex")
+	if net.stub.State[cursorKey] != nil {
+		t.Error("rerun left a cursor behind")
+	}
+}
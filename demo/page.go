@@ -0,0 +1,126 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// OpeningPage is one page of a paginated opening query
+type OpeningPage struct {
+	Items      []OpenBinObj `json:"items"`
+	NextCursor string       `json:"nextCursor"`
+}
+
+// pageOpenings pages through the index keys in [start, end) and resolves each
+// to its opening
+func pageOpenings(stub shim.ChaincodeStubInterface, start string, end string, pageSize int, cursor string) (OpeningPage, error) {
+	page := OpeningPage{Items: make([]OpenBinObj, 0)}
+	next, err := pager.Scan(stub, start, end, pageSize, cursor, func(key string, _ []byte) (bool, error) {
+		id, err := openingIdFromIndexKey(key)
+		if err != nil {
+			return false, err
+		}
+		openbin, err := findOpening(stub, id)
+		if err != nil {
+			return false, err
+		}
+		if openbin == nil {
+			fmt.Println("missing opening:", id)
+			return false, nil
+		}
+		page.Items = append(page.Items, *openbin)
+		return true, nil
+	})
+	page.NextCursor = next
+	return page, err
+}
+
+// readAllFromUser pages through one producer's openings: producer, pageSize,
+// cursor. Both page arguments are optional, so the old single argument call
+// still returns the first page. Only the producer and admins may read them.
+func readAllFromUser(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting producer, pageSize, cursor")
+	}
+	producer := args[0]
+	pageSize, cursor, err := pager.ParseArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeProducerRead(stub, producer)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := legacyChainIds(stub, producer)
+	if err != nil {
+		return nil, err
+	}
+	if len(legacy) != 0 {
+		return nil, errors.New("Producer " + producer + " still has a legacy opening chain. Invoke migrateIndex first")
+	}
+	start, end, err := statekey.PrefixRange(producerOpeningIndex, producer)
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageOpenings(stub, start, end, pageSize, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
+
+// readAll pages through every producer's openings, ordered by producer and
+// then by ID: pageSize, cursor. It fails until migrateIndex has converted
+// every legacy chain. Queries used to need a key even where readall ignored
+// it, so a lone argument that is not a page size reads the first page.
+// Only admins may read every producer's openings.
+func readAll(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) == 1 {
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			args = nil
+		}
+	}
+	pageSize, cursor, err := pager.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeProducerRead(stub, "")
+	if err != nil {
+		return nil, err
+	}
+	err = requireMigrated(stub)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := statekey.PrefixRange(producerOpeningIndex)
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageOpenings(stub, start, end, pageSize, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// page runs a paged opening query and returns the IDs on the page and its cursor
+func (n *testNet) page(function string, args ...string) ([]uint32, string) {
+	val, err := n.query("root", roleAdmin, function, args...)
+	if err != nil {
+		n.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	var page OpeningPage
+	if err := json.Unmarshal(val, &page); err != nil {
+		n.t.Fatal(err)
+	}
+	ids := make([]uint32, 0)
+	for _, openbin := range page.Items {
+		ids = append(ids, openbin.Id)
+	}
+	return ids, page.NextCursor
+}
+
+func TestReadAllPagesPastInserts(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	for _, producer := range []string{"alice", "carol", "carol"} {
+		net.mustInvoke(producer, "", "newOpening", "b1", "1476748801000")
+	}
+	ids, cursor := net.page("readall", "2")
+	if !reflect.DeepEqual(ids, []uint32{1, 2}) || cursor == "" {
+		t.Fatalf("first page = %v, cursor %q; want [1 2] and a cursor", ids, cursor)
+	}
+	// bob sorts before the cursor and dave after it
+	net.mustInvoke("bob", "", "newOpening", "b1", "1476748801000")
+	net.mustInvoke("dave", "", "newOpening", "b1", "1476748801000")
+	ids, cursor = net.page("readall", "2", cursor)
+	if !reflect.DeepEqual(ids, []uint32{3, 5}) || cursor != "" {
+		t.Errorf("second page = %v, cursor %q; want [3 5] and no cursor", ids, cursor)
+	}
+}
+
+func TestReadAllOldCalls(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748801000")
+	tests := []struct {
+		function string
+		args     []string
+	}{
+		{"readall", []string{"x"}},
+		{"readall", nil},
+		{"readalluser", []string{"alice"}},
+	}
+	for _, tt := range tests {
+		ids, _ := net.page(tt.function, tt.args...)
+		if !reflect.DeepEqual(ids, []uint32{1}) {
+			t.Errorf("%s %v = %v, want [1]", tt.function, tt.args, ids)
+		}
+	}
+	if _, err := net.query("root", roleAdmin, "readall", "0"); err == nil {
+		t.Error("readall with page size 0 succeeded")
+	}
+}
+
+func TestProducerReadAccess(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerBin", "b1", "glass", "240", "45", "9")
+	net.mustInvoke("alice", "", "newOpening", "b1", "1476748801000")
+	queries := [][]string{
+		{"readalluser", "alice"},
+		{"readrange", "0", "1476748900000", "alice"},
+	}
+	everyone := [][]string{
+		{"readall"},
+		{"readrange", "0", "1476748900000"},
+	}
+	tests := []struct {
+		user, role  string
+		own, others bool
+	}{
+		{"alice", "", true, false},
+		{"bob", "", false, false},
+		{"root", roleAdmin, true, true},
+	}
+	for _, tt := range tests {
+		for _, q := range queries {
+			_, err := net.query(tt.user, tt.role, q[0], q[1:]...)
+			if (err == nil) != tt.own {
+				t.Errorf("%v as %s: err = %v, want allowed %v", q, tt.user, err, tt.own)
+			}
+		}
+		for _, q := range everyone {
+			_, err := net.query(tt.user, tt.role, q[0], q[1:]...)
+			if (err == nil) != tt.others {
+				t.Errorf("%v as %s: err = %v, want allowed %v", q, tt.user, err, tt.others)
+			}
+		}
+	}
+	// raw state is not readable by key, not even by admins
+	if _, err := net.query("root", roleAdmin, "read", "USERLIST"); err == nil {
+		t.Error("reading a raw key succeeded")
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Openings are indexed by TimestampOpened, bucketed by UTC day:
+// opening~time/<day>/<timestamp>/<id> for everyone and
+// producer~time/<producer>/<day>/<timestamp>/<id> per producer. Keys sort by
+// time, so a time window is a single range scan.
+const (
+	timeIndex         = "opening~time"
+	producerTimeIndex = "producer~time"
+	msPerDay          = 24 * 60 * 60 * 1000
+)
+
+// dayBucket returns the UTC day a timestamp in ms falls on
+func dayBucket(ts int64) string {
+	day := ts / msPerDay
+	if ts%msPerDay < 0 {
+		day--
+	}
+	return statekey.Int(day)
+}
+
+// timeKeyAttrs returns the attributes that place a point in time in the
+// index; appending an ID gives the key of an opening at that time
+func timeKeyAttrs(ts int64) []string {
+	return []string{dayBucket(ts), statekey.Int(ts)}
+}
+
+func timeKeys(openbin *OpenBinObj) ([]string, error) {
+	attrs := append(timeKeyAttrs(openbin.TimestampOpened), statekey.Uint(uint64(openbin.Id)))
+	all, err := statekey.Create(timeIndex, attrs...)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := statekey.Create(producerTimeIndex, append([]string{openbin.Producer}, attrs...)...)
+	if err != nil {
+		return nil, err
+	}
+	return []string{all, producer}, nil
+}
+
+// timeRange returns the index range holding openings opened in [from, to),
+// either for everyone or, if producer is not empty, for one producer
+func timeRange(producer string, from int64, to int64) (string, string, error) {
+	index := timeIndex
+	var prefix []string
+	if producer != "" {
+		index = producerTimeIndex
+		prefix = []string{producer}
+	}
+	start, err := statekey.Create(index, append(prefix, timeKeyAttrs(from)...)...)
+	if err != nil {
+		return "", "", err
+	}
+	end, err := statekey.Create(index, append(prefix, timeKeyAttrs(to)...)...)
+	if err != nil {
+		return "", "", err
+	}
+	return start, end, nil
+}
+
+// dayStart returns the start in ms of the UTC day a timestamp falls on
+func dayStart(ts int64) int64 {
+	start := ts - ts%msPerDay
+	if ts%msPerDay < 0 {
+		start -= msPerDay
+	}
+	return start
+}
+
+// previousOpening returns the producer's latest opening opened in
+// [from, to), or nil. Ranges only run forward, so it walks back a day bucket
+// at a time and keeps the last key of the first bucket that has one.
+func previousOpening(stub shim.ChaincodeStubInterface, producer string, from int64, to int64) (*OpenBinObj, error) {
+	for to > from {
+		bucket := dayStart(to - 1)
+		if bucket < from {
+			bucket = from
+		}
+		start, end, err := timeRange(producer, bucket, to)
+		if err != nil {
+			return nil, err
+		}
+		last, cursor := "", ""
+		for {
+			cursor, err = pager.Scan(stub, start, end, pager.MaxSize, cursor, func(key string, _ []byte) (bool, error) {
+				last = key
+				return false, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if cursor == "" {
+				break
+			}
+		}
+		if last != "" {
+			id, err := openingIdFromIndexKey(last)
+			if err != nil {
+				return nil, err
+			}
+			return findOpening(stub, id)
+		}
+		to = bucket
+	}
+	return nil, nil
+}
+
+// nextOpening returns the producer's earliest opening opened in [from, to),
+// or nil
+func nextOpening(stub shim.ChaincodeStubInterface, producer string, from int64, to int64) (*OpenBinObj, error) {
+	start, end, err := timeRange(producer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	first := ""
+	_, err = pager.Scan(stub, start, end, 1, "", func(key string, _ []byte) (bool, error) {
+		first = key
+		return true, nil
+	})
+	if err != nil || first == "" {
+		return nil, err
+	}
+	id, err := openingIdFromIndexKey(first)
+	if err != nil {
+		return nil, err
+	}
+	return findOpening(stub, id)
+}
+
+// readRange pages through the openings opened in [from, to), ordered by
+// opening time: from, to, producer, pageSize, cursor. An empty producer
+// selects every producer. Producers may read their own openings and admins
+// everyone's.
+func readRange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 2 || len(args) > 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting from, to, producer, pageSize, cursor")
+	}
+	from, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid from " + args[0])
+	}
+	to, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid to " + args[1])
+	}
+	if to < from {
+		return nil, errors.New("to must not be before from")
+	}
+	producer := ""
+	if len(args) > 2 {
+		producer = args[2]
+	}
+	var pageArgs []string
+	if len(args) > 3 {
+		pageArgs = args[3:]
+	}
+	pageSize, cursor, err := pager.ParseArgs(pageArgs)
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeProducerRead(stub, producer)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := timeRange(producer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageOpenings(stub, start, end, pageSize, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// maxClockSkew is how far past the transaction time a client-supplied
+// timestamp may be, to allow for sensor clocks running slightly fast
+const maxClockSkew = 5 * 60 * 1000
+
+// ValidationError names the argument that was rejected and why. Its message
+// is JSON, like the other errors returned to clients.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	msg, _ := json.Marshal(struct {
+		Error  string
+		Field  string
+		Reason string
+	}{"Invalid " + e.Field + ": " + e.Reason, e.Field, e.Reason})
+	return string(msg)
+}
+
+func invalid(field string, reason string) error {
+	return &ValidationError{Field: field, Reason: reason}
+}
+
+func validateProducer(producer string) error {
+	if strings.TrimSpace(producer) == "" {
+		return invalid("producer", "must not be empty")
+	}
+	if _, err := statekey.Create(producerOpeningIndex, producer); err != nil {
+		return invalid("producer", "contains a reserved character")
+	}
+	return nil
+}
+
+func parseLatLng(field string, val string, limit float64) (float64, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, invalid(field, "not a number")
+	}
+	if f < -limit || f > limit {
+		return 0, invalid(field, "must be between -"+strconv.FormatFloat(limit, 'f', -1, 64)+" and "+strconv.FormatFloat(limit, 'f', -1, 64))
+	}
+	return f, nil
+}
+
+// parseTimestamp reads a timestamp in ms that must be positive and not
+// later than now, give or take maxClockSkew
+func parseTimestamp(field string, val string, now int64) (int64, error) {
+	ts, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, invalid(field, "not an integer timestamp in ms")
+	}
+	if ts <= 0 {
+		return 0, invalid(field, "must be positive")
+	}
+	if ts > now+maxClockSkew {
+		return 0, invalid(field, "is in the future")
+	}
+	return ts, nil
+}
+
+// parseOpening validates a producer and the newOpening times (open and
+// optionally close) and returns the opening of bin they describe, without an ID
+func parseOpening(producer string, bin *Bin, args []string, now int64) (OpenBinObj, error) {
+	var openbin OpenBinObj
+	var err error
+	if err = validateProducer(producer); err != nil {
+		return openbin, err
+	}
+	openbin.Producer = producer
+	openbin.BinId = bin.Id
+	if openbin.TimestampOpened, err = parseTimestamp("open", args[0], now); err != nil {
+		return openbin, err
+	}
+	if err = bin.checkOpenedAt(openbin.TimestampOpened); err != nil {
+		return openbin, err
+	}
+	openbin.Lat, openbin.Lng = bin.locationAt(openbin.TimestampOpened)
+	if len(args) == 2 {
+		if openbin.TimestampClosed, err = parseClose(args[1], openbin.TimestampOpened, now); err != nil {
+			return openbin, err
+		}
+	}
+	return openbin, nil
+}
+
+// parseClose reads a close timestamp for an opening that opened at opened
+func parseClose(val string, opened int64, now int64) (int64, error) {
+	closed, err := parseTimestamp("close", val, now)
+	if err != nil {
+		return 0, err
+	}
+	if closed < opened {
+		return 0, invalid("close", "is before the opening time")
+	}
+	return closed, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package identity tells chaincode who submitted a transaction.
+//
+// The caller's user name and role come from the "username" and "role"
+// attributes of the transaction certificate, never from the function
+// arguments. The local simulator runs without certificates, so a chaincode
+// deployed with dev mode enabled instead acts as whichever caller was last
+// set with SetDevCaller. Dev mode can only be switched on at deploy time.
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Certificate attributes the caller is read from
+const (
+	UserAttribute = "username"
+	RoleAttribute = "role"
+)
+
+// DevModeArg is the deploy argument that enables dev mode
+const DevModeArg = "devmode"
+
+// Caller is the user who submitted a transaction and the role they hold
+type Caller struct {
+	User string `json:"user"`
+	Role string `json:"role"`
+}
+
+func configKey(name string) (string, error) {
+	return statekey.Create("config", name)
+}
+
+// Init records whether dev mode is on, based on the deploy arguments. It must
+// only be called from a deploy, never from an invoke.
+func Init(stub shim.ChaincodeStubInterface, args []string) error {
+	key, err := configKey("devmode")
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 && args[0] == DevModeArg {
+		return stub.PutState(key, []byte("true"))
+	}
+	return stub.DelState(key)
+}
+
+// DevMode reports whether the chaincode was deployed in dev mode
+func DevMode(stub shim.ChaincodeStubInterface) (bool, error) {
+	key, err := configKey("devmode")
+	if err != nil {
+		return false, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return string(val) == "true", nil
+}
+
+// Read returns the caller of the current transaction
+func Read(stub shim.ChaincodeStubInterface) (Caller, error) {
+	var caller Caller
+	dev, err := DevMode(stub)
+	if err != nil {
+		return caller, err
+	}
+	if dev {
+		return readDevCaller(stub)
+	}
+
+	user, err := stub.ReadCertAttribute(UserAttribute)
+	if err != nil {
+		return caller, errors.New("Couldn't get attribute '" + UserAttribute + "'. Error: " + err.Error())
+	}
+	if len(user) == 0 {
+		return caller, errors.New("Attribute '" + UserAttribute + "' is empty")
+	}
+	caller.User = string(user)
+	// a certificate without a role is still a valid caller, just an unprivileged one
+	role, err := stub.ReadCertAttribute(RoleAttribute)
+	if err == nil {
+		caller.Role = string(role)
+	}
+	return caller, nil
+}
+
+// SetDevCaller makes every following transaction act as caller. It fails
+// unless the chaincode was deployed in dev mode.
+func SetDevCaller(stub shim.ChaincodeStubInterface, caller Caller) error {
+	dev, err := DevMode(stub)
+	if err != nil {
+		return err
+	}
+	if !dev {
+		return errors.New("Dev mode is not enabled")
+	}
+	if caller.User == "" {
+		return errors.New("Dev caller needs a user")
+	}
+	key, err := configKey("devcaller")
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(&caller)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, val)
+}
+
+func readDevCaller(stub shim.ChaincodeStubInterface) (Caller, error) {
+	var caller Caller
+	key, err := configKey("devcaller")
+	if err != nil {
+		return caller, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return caller, err
+	}
+	if len(val) == 0 {
+		return caller, errors.New("Dev mode is enabled but no caller is set. Invoke setDevCaller first")
+	}
+	err = json.Unmarshal(val, &caller)
+	return caller, err
+}
@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package identity_test
+
+import (
+	"testing"
+
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/mockstub"
+)
+
+func TestReadFromCertificate(t *testing.T) {
+	tests := []struct {
+		name    string
+		attrs   map[string]string
+		want    identity.Caller
+		wantErr bool
+	}{
+		{"user and role", map[string]string{"username": "alice", "role": "admin"}, identity.Caller{User: "alice", Role: "admin"}, false},
+		{"no role", map[string]string{"username": "alice"}, identity.Caller{User: "alice"}, false},
+		{"no user", map[string]string{"role": "admin"}, identity.Caller{}, true},
+		{"empty user", map[string]string{"username": "", "role": "admin"}, identity.Caller{}, true},
+	}
+	for _, tt := range tests {
+		stub := mockstub.New()
+		if err := identity.Init(stub, nil); err != nil {
+			t.Fatal(err)
+		}
+		stub.Attrs = tt.attrs
+		got, err := identity.Read(stub)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Read() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Read() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	stub := mockstub.New()
+	if err := identity.Init(stub, []string{identity.DevModeArg}); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err := identity.DevMode(stub); err != nil || !dev {
+		t.Fatalf("DevMode() = %v, %v; want true", dev, err)
+	}
+	if _, err := identity.Read(stub); err == nil {
+		t.Error("Read() before SetDevCaller succeeded")
+	}
+	dev := identity.Caller{User: "bob", Role: "producer"}
+	if err := identity.SetDevCaller(stub, dev); err != nil {
+		t.Fatal(err)
+	}
+	// certificate attributes are ignored in dev mode
+	stub.SetCaller("alice", "admin")
+	if got, err := identity.Read(stub); err != nil || got != dev {
+		t.Errorf("Read() = %+v, %v; want %+v", got, err, dev)
+	}
+	if err := identity.SetDevCaller(stub, identity.Caller{Role: "admin"}); err == nil {
+		t.Error("SetDevCaller() without a user succeeded")
+	}
+}
+
+func TestSetDevCallerNeedsDevMode(t *testing.T) {
+	stub := mockstub.New()
+	if err := identity.Init(stub, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.SetDevCaller(stub, identity.Caller{User: "bob"}); err == nil {
+		t.Fatal("SetDevCaller() without dev mode succeeded")
+	}
+	stub.SetCaller("alice", "")
+	if got, err := identity.Read(stub); err != nil || got.User != "alice" {
+		t.Errorf("Read() = %+v, %v; want alice", got, err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Once a waste is disposed of, the party that disposed of it may issue a
+// disposal certificate, stored under certificate/<id>. A waste has at most
+// one certificate. The certificate carries the SHA-256 of its content, so a
+// copy filed with an authority can be checked against the ledger with
+// verifyCertificate.
+const certificateTable = "certificate"
+
+// CertificateContent is what a certificate attests to, and what its hash
+// covers. Lots merged or split from others name their parents and original
+// producers; lineage traces the rest of the way.
+type CertificateContent struct {
+	WasteId           string            `json:"wasteId"`
+	WasteVersion      uint64            `json:"wasteVersion"`
+	Producer          string            `json:"producer"`
+	EwcCode           string            `json:"ewcCode"`
+	Hazardous         bool              `json:"hazardous"`
+	Unit              string            `json:"unit"`
+	QuantityProduced  int               `json:"quantityProduced"`
+	Custody           []CustodyTransfer `json:"custody"`
+	FinalHolder       string            `json:"finalHolder"`
+	FinalQuantity     int               `json:"finalQuantity"`
+	Parents           []string          `json:"parents,omitempty"`
+	OriginalProducers []string          `json:"originalProducers,omitempty"`
+	IssuedBy          string            `json:"issuedBy"`
+	TimestampIssued   int64             `json:"timestampIssued"`
+	TxID              string            `json:"txId"`
+}
+
+// Certificate is a disposal certificate as stored
+type Certificate struct {
+	CertificateContent
+	Hash string `json:"hash"` //hex SHA-256 of the JSON encoded content
+}
+
+// CertificateCheck is the result of verifyCertificate. Problems lists why
+// the certificate does not hold; it is empty when Valid.
+type CertificateCheck struct {
+	Certificate Certificate `json:"certificate"`
+	Valid       bool        `json:"valid"`
+	Problems    []string    `json:"problems"`
+}
+
+func certificateKey(id string) (string, error) {
+	return statekey.Create(certificateTable, id)
+}
+
+// certificateContent describes a disposed waste as it stands
+func certificateContent(waste *Waste, issuedBy string, timestamp int64, txID string) CertificateContent {
+	custody := waste.Custody
+	if custody == nil {
+		custody = make([]CustodyTransfer, 0)
+	}
+	return CertificateContent{
+		WasteId:           waste.Id,
+		WasteVersion:      waste.Version,
+		Producer:          waste.Producer,
+		EwcCode:           waste.EwcCode,
+		Hazardous:         waste.Hazardous,
+		Unit:              waste.Unit,
+		QuantityProduced:  waste.QuantityProduced,
+		Custody:           custody,
+		FinalHolder:       wasteHolder(waste),
+		FinalQuantity:     lotQuantity(waste),
+		Parents:           waste.Parents,
+		OriginalProducers: waste.OriginalProducers,
+		IssuedBy:          issuedBy,
+		TimestampIssued:   timestamp,
+		TxID:              txID,
+	}
+}
+
+func hashCertificate(content *CertificateContent) (string, error) {
+	val, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(val)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func readCertificate(stub shim.ChaincodeStubInterface, id string) (*Certificate, error) {
+	key, err := certificateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var cert Certificate
+	err = json.Unmarshal(val, &cert)
+	if err != nil {
+		return nil, errors.New("Corrupt certificate " + string(val))
+	}
+	return &cert, nil
+}
+
+// issueCertificate certifies the disposal of a waste: id. Only the party
+// that disposed of the waste may issue its certificate.
+func (t *SimpleChaincode) issueCertificate(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. id")
+	}
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if wasteState(&waste) != stateDisposed {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " is " + wasteState(&waste) + "; only disposed wastes are certified\"}")
+	}
+	if wasteHolder(&waste) != caller.User {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " was not disposed of by " + caller.User + "\"}")
+	}
+	existing, err := readCertificate(stub, waste.Id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " already has a certificate\"}")
+	}
+
+	cert := Certificate{CertificateContent: certificateContent(&waste, caller.User, timestamp, stub.GetTxID())}
+	cert.Hash, err = hashCertificate(&cert.CertificateContent)
+	if err != nil {
+		return nil, err
+	}
+	key, err := certificateKey(waste.Id)
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&cert)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, val)
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// verifyCertificate checks a waste's certificate: id, and optionally the
+// hash printed on a copy of it. The stored hash must match the stored
+// content, and the content must still match the waste as it stands.
+func (t *SimpleChaincode) verifyCertificate(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, hash")
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeWasteRead(stub, caller, &waste)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := readCertificate(stub, waste.Id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " has no certificate\"}")
+	}
+
+	check := CertificateCheck{Certificate: *cert, Problems: make([]string, 0)}
+	hash, err := hashCertificate(&cert.CertificateContent)
+	if err != nil {
+		return nil, err
+	}
+	if hash != cert.Hash {
+		check.Problems = append(check.Problems, "hash does not match the certificate content")
+	}
+	if len(args) == 2 && args[1] != cert.Hash {
+		check.Problems = append(check.Problems, "hash does not match the one given")
+	}
+	current := certificateContent(&waste, cert.IssuedBy, cert.TimestampIssued, cert.TxID)
+	hash, err = hashCertificate(&current)
+	if err != nil {
+		return nil, err
+	}
+	if hash != cert.Hash {
+		check.Problems = append(check.Problems, "waste has changed since the certificate was issued")
+	}
+	check.Valid = len(check.Problems) == 0
+	return json.Marshal(&check)
+}
@@ -20,10 +20,11 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
-	"time"
 	"encoding/json"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/txclock"
 )
 
 type Waste struct {
@@ -35,15 +36,29 @@ type Waste struct {
 	Retriever			string  `json:"retriever"`
 	TimestampRetrieved	int64	`json:"timestampRetrieved"`	//utc timestamp of assignment
 	QualityRetrieved    int 	`json:"qualityRetrieved"`
+	State				string	`json:"state"`	//produced, assigned, collected, disposed or cancelled
+	Version				uint64	`json:"version"`	//bumped by every write, see wasteHistory
+	EwcCode				string	`json:"ewcCode"`	//European Waste Catalogue code, e.g. "20 03 01"
+	Hazardous			bool	`json:"hazardous"`	//from the catalogue entry of EwcCode
+	PhysicalState		string	`json:"physicalState"`	//solid, liquid, sludge or gas
+	Unit				string	`json:"unit"`	//unit of the quantities: kg, l or m3
+	Holder				string	`json:"holder"`	//who has custody once collected
+	Custody				[]CustodyTransfer	`json:"custody"`	//every handover since collection, oldest first
+	QuantityCollected	int		`json:"quantityCollected"`	//as measured by the collector
+	Discrepancy			bool	`json:"discrepancy"`	//collected quantity was outside the tolerance policy
+	Points				int64	`json:"points"`	//credited to the producer for QualityRetrieved
+	CollectionDeadline	int64	`json:"collectionDeadline"`	//utc timestamp the SLA requires collection by, 0 if none
+	SlaBreached			bool	`json:"slaBreached"`	//collected after CollectionDeadline
+	Parents				[]string	`json:"parents"`	//lots this one was merged or split from
+	Children			[]string	`json:"children"`	//lots this one was merged or split into
+	OriginalProducers	[]string	`json:"originalProducers"`	//who produced the lots this one came from, if it has parents
 }
 
-type Waste_Holder struct {
-	wId 	[]string `json:"wids"`
-}
 
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
+	clock txclock.Clock	// nil means the transaction timestamp
 }
 
 func main() {
@@ -59,26 +74,12 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
 
-	var wasteIDs Waste_Holder
-	//slcD := []string{"apple", "peach", "pear"}
-	//wasteIDs.wId = slcD
-	
-//	var bytes [5]byte 
-	//for debug
-//	wasteIDs.wId = [5]string{'1', '2', 'A', 'B', 'AA'}
-
-	bytes, err := json.Marshal(wasteIDs)
-
-    if err != nil { 
-		return nil, errors.New("Error creating wasteIDs record") 
-	}
-
-	err = stub.PutState("wasteIDs", bytes)
+	err := seedPermissions(stub)
 	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	return nil, identity.Init(stub, args)
 }
 
 
@@ -86,22 +87,65 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
 
-	//user, err := t.get_username(stub)
-	user := "PIPPO"
-	
-	fmt.Println("username: " + user)
-	
-	//if err != nil { return nil, err}
-
 	// Handle different functions
+	// Init resets the waste list, reseeds the default permissions and resets
+	// dev mode, so it only runs when deploying
 	if function == "init" {
-		return t.Init(stub, "init", args)
+		return nil, errors.New("init can only run when deploying")
+	} else if function == "setDevCaller" {
+		return t.setDevCaller(stub, args)
+	}
+
+	caller, err := identity.Read(stub)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("username: " + caller.User)
+
+	// nothing is read or written on behalf of a caller whose role does not allow it
+	err = authorize(stub, caller, function)
+	if err != nil {
+		return nil, err
+	}
+
+	if function == "grantRole" {
+		return t.grantRole(stub, args)
+	} else if function == "revokeRole" {
+		return t.revokeRole(stub, args)
+	} else if function == "setEwcCode" {
+		return t.setEwcCode(stub, args)
+	} else if function == "removeEwcCode" {
+		return t.removeEwcCode(stub, args)
+	} else if function == "setTolerance" {
+		return t.setTolerance(stub, args)
+	} else if function == "setQualityPoints" {
+		return t.setQualityPoints(stub, args)
+	} else if function == "setSlaWindow" {
+		return t.setSlaWindow(stub, args)
+	} else if function == "registerCollector" {
+		return t.registerCollector(stub, args)
+	} else if function == "removeCollector" {
+		return t.removeCollector(stub, args)
 	} else if function == "newWaste" {
-		user := "PROD"
-		return t.newWaste(stub, user, args)
+		return t.newWaste(stub, caller, args)
+	} else if function == "assignWaste" {
+		return t.assignWaste(stub, caller, args)
 	} else if function == "collect" {
-		user := "COLL"
-		return t.collectWaste(stub, user, args)
+		return t.collectWaste(stub, caller, args)
+	} else if function == "correctCollection" {
+		return t.correctCollection(stub, caller, args)
+	} else if function == "mergeWastes" {
+		return t.mergeWastes(stub, caller, args)
+	} else if function == "splitWaste" {
+		return t.splitWaste(stub, caller, args)
+	} else if function == "transferWaste" {
+		return t.transferWaste(stub, caller, args)
+	} else if function == "disposeWaste" {
+		return t.disposeWaste(stub, caller, args)
+	} else if function == "issueCertificate" {
+		return t.issueCertificate(stub, caller, args)
+	} else if function == "cancelWaste" {
+		return t.cancelWaste(stub, caller, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
 
@@ -112,9 +156,50 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function) 
 	fmt.Println(args)
+	caller, err := identity.Read(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = authorize(stub, caller, function)
+	if err != nil {
+		return nil, err
+	}
+
 	// Handle different functions
-	if function == "readWaste" { //read a variable
-		waste, err := t.readWasteB(stub, args)
+	if function == "permissions" {
+		return t.readPermissions(stub, args)
+	} else if function == "ewcCatalogue" {
+		return t.readEwcCatalogue(stub, args)
+	} else if function == "pointsSchedule" {
+		return t.readPointsSchedule(stub, args)
+	} else if function == "balance" {
+		return t.balance(stub, caller, args)
+	} else if function == "statement" {
+		return t.statement(stub, caller, args)
+	} else if function == "slaWindows" {
+		return t.readSlaWindows(stub, args)
+	} else if function == "overdue" {
+		return t.overdue(stub, caller, args)
+	} else if function == "collectors" {
+		return t.readCollectorRegistry(stub, args)
+	} else if function == "planAssignments" {
+		return t.planAssignments(stub, args)
+	} else if function == "tolerance" {
+		return t.readTolerancePolicy(stub, args)
+	} else if function == "discrepancies" {
+		return t.discrepancies(stub, caller, args)
+	} else if function == "verifyCertificate" {
+		return t.verifyCertificate(stub, caller, args)
+	} else if function == "lineage" {
+		return t.lineage(stub, caller, args)
+	} else if function == "custodyChain" {
+		return t.custodyChain(stub, caller, args)
+	} else if function == "wasteHistory" {
+		return t.wasteHistory(stub, caller, args)
+	} else if function == "listWastes" {
+		return t.listWastes(stub, caller, args)
+	} else if function == "readWaste" { //read a variable
+		waste, err := t.readWasteB(stub, caller, args)
 		if err != nil { 
 			return nil, err
 		}
@@ -127,7 +212,7 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 }
 
 // write - invoke function to write key/value pair
-func (t *SimpleChaincode) newWaste(stub shim.ChaincodeStubInterface, user string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) newWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
 	var id string
 	var quantity int
 	var timestamp int64
@@ -135,24 +220,46 @@ func (t *SimpleChaincode) newWaste(stub shim.ChaincodeStubInterface, user string
 	var waste Waste
 	fmt.Println("running write()")
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. id, quantity")
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5. id, quantity, ewcCode, physicalState, unit")
 	}
 
 	id = args[0] //rename for funsies
-	quantity, _ = strconv.Atoi(args[1])
-	timestamp = makeTimestamp()
+	if id == "" {
+		return nil, errors.New("Waste id must not be empty")
+	}
+	// newWaste only creates; reusing an id would wipe the existing record
+	exists, err := wasteExists(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, errors.New("{\"Error\":\"Waste " + id + " already exists\"}")
+	}
+	quantity, err = strconv.Atoi(args[1])
+	if err != nil || quantity <= 0 {
+		return nil, errors.New("{\"Error\":\"Invalid quantity '" + args[1] + "'. Expecting a positive integer\"}")
+	}
+	err = classifyWaste(stub, &waste, args[2], args[3], args[4])
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err = t.now(stub)
+	if err != nil {
+		return nil, err
+	}
 	
 	waste.Id = id
-	waste.Producer = user
+	waste.Producer = caller.User
 	waste.QuantityProduced = quantity
 	waste.TimestampProduced = timestamp
-	return writeWaste(stub, &waste)
+	waste.State = stateProduced
+	return t.writeWaste(stub, caller.User, &waste)
 
 }
 
 
-func (t *SimpleChaincode) collectWaste(stub shim.ChaincodeStubInterface, user string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) collectWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
 
 //		Retriever			string  `json:"retriever"`
 //	TimestampRetrieved	int64	`json:"timestampRetrieved"`	//utc timestamp of assignment
@@ -160,49 +267,131 @@ func (t *SimpleChaincode) collectWaste(stub shim.ChaincodeStubInterface, user st
 	
 	var waste Waste
 	var err error
-	if len(args)!=2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. id, quality")
+	if len(args)!=3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3. id, quality, quantity")
 	}
 	id := args[0]
-	retriever := user
-	quality, _ := strconv.Atoi(args[1])
+	retriever := caller.User
+	quality, quantity, err := parseCollection(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
 
-	timestamp := makeTimestamp()
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
 	
 	waste, err = readWaste (stub, id)
 	if (err != nil) {
 		return nil, err
 	}
+	err = transition(&waste, stateCollected)
+	if err != nil {
+		return nil, err
+	}
+	if waste.Retriever != retriever {
+		return nil, errors.New("{\"Error\":\"Waste " + id + " is not assigned to " + retriever + "\"}")
+	}
 	waste.Retriever = retriever
 	waste.TimestampRetrieved = timestamp
+	waste.SlaBreached = waste.CollectionDeadline != 0 && timestamp > waste.CollectionDeadline
 	waste.QualityRetrieved = quality
-	return writeWaste(stub, &waste)
+	err = recordCollectedQuantity(stub, &waste, quantity)
+	if err != nil {
+		return nil, err
+	}
+	handOver(&waste, waste.Producer, retriever, timestamp, quantity)
+	err = creditCollection(stub, &waste, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return t.writeWaste(stub, caller.User, &waste)
 	
 }
 
+// parseCollection reads the quality and quantity a collector records
+func parseCollection(qualityArg string, quantityArg string) (int, int, error) {
+	quality, err := strconv.Atoi(qualityArg)
+	if err != nil {
+		return 0, 0, errors.New("{\"Error\":\"Invalid quality '" + qualityArg + "'. Expecting an integer\"}")
+	}
+	quantity, err := strconv.Atoi(quantityArg)
+	if err != nil || quantity < 0 {
+		return 0, 0, errors.New("{\"Error\":\"Invalid quantity '" + quantityArg + "'. Expecting a non-negative integer\"}")
+	}
+	return quality, quantity, nil
+}
+
+// correctCollection lets the collector fix the quality and quantity recorded
+// at collection: id, quality, quantity. The points posted for the collection
+// are reversed and the corrected points posted, and the discrepancy flag and
+// the collection handover are recomputed.
+func (t *SimpleChaincode) correctCollection(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3. id, quality, quantity")
+	}
+	quality, quantity, err := parseCollection(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	state := wasteState(&waste)
+	if state != stateCollected && state != stateDisposed {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " is " + state + "; only collections can be corrected\"}")
+	}
+	if waste.Retriever != caller.User {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " was not collected by " + caller.User + "\"}")
+	}
+	err = reverseCollection(stub, &waste, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	waste.QualityRetrieved = quality
+	err = recordCollectedQuantity(stub, &waste, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if len(waste.Custody) != 0 {
+		waste.Custody[0].Quantity = quantity
+	}
+	err = creditCollection(stub, &waste, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return t.writeWaste(stub, caller.User, &waste)
+}
+
 
 
 // ============================================================================================================================
-// Make Timestamp - create a timestamp in ms
+// now - the transaction time in ms, identical on every peer
 // ============================================================================================================================
-func makeTimestamp() int64 {
-    return time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
+func (t *SimpleChaincode) now(stub shim.ChaincodeStubInterface) (int64, error) {
+	return txclock.Or(t.clock).Now(stub)
 }
 
 //==============================================================================================================================
-//	 get_caller - Retrieves the username of the user who invoked the chaincode.
-//				  Returns the username as a string.
+//	 setDevCaller - Chooses who the following transactions act as when deployed in dev mode.
+//					Callers otherwise come from the username and role attributes of their certificate.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
-
-    username, err := stub.ReadCertAttribute("username");
-	if err != nil { return "", errors.New("Couldn't get attribute 'username'. Error: " + err.Error()) }
-	return string(username), nil
+func (t *SimpleChaincode) setDevCaller(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. user, role")
+	}
+	return nil, identity.SetDevCaller(stub, identity.Caller{User: args[0], Role: args[1]})
 }
 
 
-func (t *SimpleChaincode) readWasteB(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+func (t *SimpleChaincode) readWasteB(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
 	var key, jsonResp string
 	
 	
@@ -217,7 +406,19 @@ func (t *SimpleChaincode) readWasteB(stub shim.ChaincodeStubInterface, args []st
 		return nil, errors.New(jsonResp)
 	}
 	fmt.Println("Retrieving:" + string(valAsbytes))
-	return valAsbytes, err
+	if len(valAsbytes) == 0 {
+		return nil, wasteNotFound(key)
+	}
+	var waste Waste
+	err = json.Unmarshal(valAsbytes, &waste)
+	if err != nil {
+		return nil, errors.New("RETRIEVE_WASTE: Corrupt waste record"+string(valAsbytes))
+	}
+	err = authorizeWasteRead(stub, caller, &waste)
+	if err != nil {
+		return nil, err
+	}
+	return valAsbytes, nil
 }
 
 // read - query function to read key/value pair
@@ -234,6 +435,9 @@ func readWaste(stub shim.ChaincodeStubInterface, key string) (Waste, error) {
 		//errors.New(jsonResp)
 	}
 	fmt.Println("Retrieving:" + string(valAsbytes))
+	if len(valAsbytes) == 0 {
+		return waste, wasteNotFound(key)
+	}
 	err = json.Unmarshal(valAsbytes, &waste);
     if err != nil {	
 		fmt.Printf("retrieve WASTE: Corrupt Waste "+string(valAsbytes)+": %s", err) 
@@ -242,17 +446,61 @@ func readWaste(stub shim.ChaincodeStubInterface, key string) (Waste, error) {
 	return waste, nil
 }
 
-func writeWaste(stub shim.ChaincodeStubInterface, waste *Waste) ([]byte, error) {
+func wasteNotFound(key string) error {
+	return errors.New("{\"Error\":\"Waste " + key + " not found\"}")
+}
+
+// wasteExists reports whether a waste is stored under id
+func wasteExists(stub shim.ChaincodeStubInterface, id string) (bool, error) {
+	valAsbytes, err := stub.GetState(id)
+	if err != nil {
+		return false, err
+	}
+	return len(valAsbytes) != 0, nil
+}
+
+// writeWaste stores a waste written by actor, updating its indexes and appending it to its history
+func (t *SimpleChaincode) writeWaste(stub shim.ChaincodeStubInterface, actor string, waste *Waste) ([]byte, error) {
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev *Waste
+	prevBytes, err := stub.GetState(waste.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(prevBytes) != 0 {
+		prev = new(Waste)
+		err = json.Unmarshal(prevBytes, prev)
+		if err != nil {
+			return nil, errors.New("RETRIEVE_WASTE: Corrupt waste record"+string(prevBytes))
+		}
+	}
+	if prev != nil {
+		waste.Version = prev.Version + 1
+	} else {
+		waste.Version = 1
+	}
+	err = updateWasteIndexes(stub, prev, waste)
+	if err != nil {
+		return nil, err
+	}
+	
 	wByte, err := json.Marshal(*waste)
 	fmt.Println("Writing:" + string(wByte))
 	if err != nil {
 		return nil, err
 	}
-	
 	err = stub.PutState(waste.Id, []byte(wByte)) //write the variable into the chaincode state
 	if err != nil {
 		return nil, err
 	}
+	err = appendHistory(stub, actor, timestamp, prev, waste)
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 
 }
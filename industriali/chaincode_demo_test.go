@@ -0,0 +1,164 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/mockstub"
+	"github.com/iorfix/learn-chaincode/txclock"
+)
+
+const deployedAt = 1476748800000
+
+// testNet is a chaincode deployed on a mock stub, with the EWC code
+// 20 03 01 in its catalogue
+type testNet struct {
+	t    *testing.T
+	cc   *SimpleChaincode
+	stub *mockstub.Stub
+}
+
+func deploy(t *testing.T, cc *SimpleChaincode, arg string) *testNet {
+	stub := mockstub.New()
+	stub.Timestamp = deployedAt
+	if _, err := cc.Init(stub, "init", []string{arg}); err != nil {
+		t.Fatal(err)
+	}
+	net := &testNet{t: t, cc: cc, stub: stub}
+	if arg != identity.DevModeArg {
+		net.mustInvoke("root", roleAdmin, "setEwcCode", "20 03 01", "false", "mixed municipal waste")
+	}
+	return net
+}
+
+// invoke runs function as user with role, one second after the previous transaction
+func (n *testNet) invoke(user string, role string, function string, args ...string) error {
+	n.stub.SetCaller(user, role)
+	n.stub.TxID = function
+	n.stub.Timestamp += 1000
+	_, err := n.cc.Invoke(n.stub, function, args)
+	return err
+}
+
+func (n *testNet) mustInvoke(user string, role string, function string, args ...string) {
+	if err := n.invoke(user, role, function, args...); err != nil {
+		n.t.Fatalf("%s %v: %v", function, args, err)
+	}
+}
+
+func (n *testNet) query(user string, role string, function string, args ...string) ([]byte, error) {
+	n.stub.SetCaller(user, role)
+	return n.cc.Query(n.stub, function, args)
+}
+
+func (n *testNet) waste(id string) Waste {
+	val, err := n.query("root", roleAuditor, "readWaste", id)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	var waste Waste
+	if err := json.Unmarshal(val, &waste); err != nil {
+		n.t.Fatal(err)
+	}
+	return waste
+}
+
+func TestInitOnlyOnDeploy(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "revokeRole", roleProducer, "newWaste")
+	for _, role := range []string{roleAdmin, roleProducer, ""} {
+		if err := net.invoke("mallory", role, "init", "0"); err == nil {
+			t.Errorf("init invoked with role %q succeeded", role)
+		}
+	}
+	// the revocation survives
+	if err := net.invoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg"); err == nil {
+		t.Error("newWaste succeeded after it was revoked")
+	}
+}
+
+func TestDevCaller(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	if err := net.invoke("p1", roleProducer, "setDevCaller", "root", roleAdmin); err == nil {
+		t.Fatal("setDevCaller succeeded without dev mode")
+	}
+
+	net = deploy(t, new(SimpleChaincode), identity.DevModeArg)
+	net.mustInvoke("", "", "setDevCaller", "root", roleAdmin)
+	net.mustInvoke("", "", "setEwcCode", "20 03 01", "false", "mixed municipal waste")
+	net.mustInvoke("", "", "setDevCaller", "p1", roleProducer)
+	// certificates are ignored in dev mode
+	net.mustInvoke("root", roleAdmin, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	if producer := net.waste("w1").Producer; producer != "p1" {
+		t.Errorf("Producer = %q, want p1", producer)
+	}
+}
+
+func TestWasteIds(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		role     string
+		function string
+		args     []string
+		query    bool
+		wantErr  string
+	}{
+		{"new id", "p1", roleProducer, "newWaste", []string{"w2", "10", "20 03 01", "solid", "kg"}, false, ""},
+		{"same id", "p1", roleProducer, "newWaste", []string{"w1", "20", "20 03 01", "solid", "kg"}, false, "Waste w1 already exists"},
+		{"same id, other producer", "p2", roleProducer, "newWaste", []string{"w1", "20", "20 03 01", "solid", "kg"}, false, "Waste w1 already exists"},
+		{"read unknown", "a1", roleAuditor, "readWaste", []string{"nope"}, true, "Waste nope not found"},
+		{"collect unknown", "c1", roleCollector, "collect", []string{"nope", "5", "10"}, false, "Waste nope not found"},
+	}
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	for _, tt := range tests {
+		var err error
+		if tt.query {
+			_, err = net.query(tt.user, tt.role, tt.function, tt.args...)
+		} else {
+			err = net.invoke(tt.user, tt.role, tt.function, tt.args...)
+		}
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+	// the duplicates left the original untouched
+	if waste := net.waste("w1"); waste.Producer != "p1" || waste.QuantityProduced != 10 || waste.Version != 1 {
+		t.Errorf("w1 = %+v, want the first newWaste", waste)
+	}
+}
+
+func TestWasteTimestamps(t *testing.T) {
+	// a day after the transaction timestamps, so only the clock can produce it
+	const now = deployedAt + 24*60*60*1000
+	net := deploy(t, &SimpleChaincode{clock: txclock.Fixed(now)}, "0")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "c1", "100", "kg", "", "20 03 01")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	net.mustInvoke("p1", roleProducer, "assignWaste", "w1", "c1")
+	waste := net.waste("w1")
+	if waste.TimestampProduced != now || waste.TimestampAssigned != now {
+		t.Errorf("TimestampProduced = %d, TimestampAssigned = %d, want %d", waste.TimestampProduced, waste.TimestampAssigned, int64(now))
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+)
+
+// A collected waste may pass through several hands (collector, transfer
+// station, treatment plant) before it is disposed of. Each handover is
+// appended to the waste's Custody chain, and Holder names whoever has it now.
+// Collection is the first handover, from the producer to the collector.
+
+// CustodyTransfer is one handover of a waste
+type CustodyTransfer struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Timestamp int64  `json:"timestamp"`
+	Quantity  int    `json:"quantity"` //in the waste's unit, as handed over
+}
+
+// wasteHolder returns who has custody of a waste. Wastes collected before
+// custody was tracked are held by their collector.
+func wasteHolder(waste *Waste) string {
+	if waste.Holder == "" && waste.TimestampRetrieved != 0 {
+		return waste.Retriever
+	}
+	return waste.Holder
+}
+
+// handOver appends a transfer to the custody chain and makes its recipient the holder
+func handOver(waste *Waste, from string, to string, timestamp int64, quantity int) {
+	waste.Custody = append(waste.Custody, CustodyTransfer{From: from, To: to, Timestamp: timestamp, Quantity: quantity})
+	waste.Holder = to
+}
+
+// isParty reports whether user produced, was assigned, holds or has held a
+// waste, or produced a lot it came from
+func isParty(waste *Waste, user string) bool {
+	if waste.Retriever == user || wasteHolder(waste) == user || contains(originalProducers(waste), user) {
+		return true
+	}
+	for _, c := range waste.Custody {
+		if c.To == user {
+			return true
+		}
+	}
+	return false
+}
+
+// transferWaste hands custody of a collected waste from the caller, who
+// must hold it, to the next party: id, to, quantity. The next party must be
+// in the collector registry and licensed for the waste's EWC code.
+func (t *SimpleChaincode) transferWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3. id, to, quantity")
+	}
+	to := args[1]
+	if to == "" {
+		return nil, errors.New("Recipient must not be empty")
+	}
+	quantity, err := strconv.Atoi(args[2])
+	if err != nil || quantity <= 0 {
+		return nil, errors.New("{\"Error\":\"Invalid quantity '" + args[2] + "'. Expecting a positive integer\"}")
+	}
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if wasteState(&waste) != stateCollected {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " is " + wasteState(&waste) + "; only collected wastes change hands\"}")
+	}
+	if wasteHolder(&waste) != caller.User {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " is not held by " + caller.User + "\"}")
+	}
+	if to == caller.User {
+		return nil, errors.New("{\"Error\":\"" + caller.User + " already holds waste " + waste.Id + "\"}")
+	}
+	_, err = checkLicensed(stub, &waste, to)
+	if err != nil {
+		return nil, err
+	}
+	handOver(&waste, caller.User, to, timestamp, quantity)
+	return t.writeWaste(stub, caller.User, &waste)
+}
+
+// custodyChain returns the handovers of a waste, oldest first: id
+func (t *SimpleChaincode) custodyChain(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. id")
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeWasteRead(stub, caller, &waste)
+	if err != nil {
+		return nil, err
+	}
+	chain := waste.Custody
+	if chain == nil {
+		chain = make([]CustodyTransfer, 0)
+	}
+	return json.Marshal(&chain)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransferRecipient(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "setEwcCode", "15 01 01", "false", "paper and cardboard packaging")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "c1", "100", "kg", "", "20 03 01")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "s1", "100", "kg", "", "20 03 01")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "s2", "100", "kg", "", "15 01 01")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	net.mustInvoke("p1", roleProducer, "assignWaste", "w1", "c1")
+	net.mustInvoke("c1", roleCollector, "collect", "w1", "5", "10")
+
+	tests := []struct {
+		to      string
+		wantErr string
+	}{
+		{"nobody", "Collector nobody is not registered"},
+		{"s2", "Collector s2 is not licensed for EWC code '20 03 01'"},
+		{"s1", ""},
+	}
+	for _, tt := range tests {
+		err := net.invoke("c1", roleCollector, "transferWaste", "w1", tt.to, "10")
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("transfer to %s: %v", tt.to, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("transfer to %s: error = %v, want %q", tt.to, err, tt.wantErr)
+		}
+	}
+	waste := net.waste("w1")
+	if holder := wasteHolder(&waste); holder != "s1" {
+		t.Errorf("w1 is held by %s, want s1", holder)
+	}
+}
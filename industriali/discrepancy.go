@@ -0,0 +1,185 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// A collector records the quantity actually collected. When it differs from
+// QuantityProduced by more than the tolerance policy allows, the waste is
+// flagged as a discrepancy and indexed under producer~discrepancy/<producer>/<id>
+// and retriever~discrepancy/<retriever>/<id>. The policy in force at
+// collection decides the flag; changing the policy later does not reflag
+// wastes already collected.
+const (
+	policyTable               = "policy"
+	producerDiscrepancyIndex  = "producer~discrepancy"
+	retrieverDiscrepancyIndex = "retriever~discrepancy"
+)
+
+// TolerancePolicy is how far a collected quantity may stray from the
+// produced quantity: the larger of Percent of QuantityProduced and Absolute
+// units. Until an admin sets a policy every difference is flagged.
+type TolerancePolicy struct {
+	Percent  float64 `json:"percent"`
+	Absolute int     `json:"absolute"`
+}
+
+func (p *TolerancePolicy) allows(produced int, collected int) bool {
+	allowed := math.Max(float64(produced)*p.Percent/100, float64(p.Absolute))
+	return math.Abs(float64(collected-produced)) <= allowed
+}
+
+func toleranceKey() (string, error) {
+	return statekey.Create(policyTable, "tolerance")
+}
+
+func readTolerance(stub shim.ChaincodeStubInterface) (TolerancePolicy, error) {
+	var policy TolerancePolicy
+	key, err := toleranceKey()
+	if err != nil {
+		return policy, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return policy, err
+	}
+	if len(val) == 0 {
+		return policy, nil
+	}
+	err = json.Unmarshal(val, &policy)
+	if err != nil {
+		return policy, errors.New("Corrupt tolerance policy " + string(val))
+	}
+	return policy, nil
+}
+
+// discrepancyIndexKeys returns the keys indexing a flagged waste
+func discrepancyIndexKeys(waste *Waste) [][]string {
+	if !waste.Discrepancy {
+		return nil
+	}
+	keys := [][]string{{retrieverDiscrepancyIndex, waste.Retriever, waste.Id}}
+	for _, producer := range originalProducers(waste) {
+		keys = append(keys, []string{producerDiscrepancyIndex, producer, waste.Id})
+	}
+	return keys
+}
+
+// recordCollectedQuantity stores the quantity collected and flags the
+// waste if it is outside the tolerance policy
+func recordCollectedQuantity(stub shim.ChaincodeStubInterface, waste *Waste, quantity int) error {
+	policy, err := readTolerance(stub)
+	if err != nil {
+		return err
+	}
+	waste.QuantityCollected = quantity
+	waste.Discrepancy = !policy.allows(waste.QuantityProduced, quantity)
+	return nil
+}
+
+// setTolerance sets the tolerance policy: percent, absolute
+func (t *SimpleChaincode) setTolerance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. percent, absolute")
+	}
+	percent, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || !(percent >= 0 && percent <= 100) {
+		return nil, errors.New("{\"Error\":\"Invalid percent '" + args[0] + "'. Expecting 0 to 100\"}")
+	}
+	absolute, err := strconv.Atoi(args[1])
+	if err != nil || absolute < 0 {
+		return nil, errors.New("{\"Error\":\"Invalid absolute tolerance '" + args[1] + "'. Expecting a non-negative integer\"}")
+	}
+	key, err := toleranceKey()
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&TolerancePolicy{Percent: percent, Absolute: absolute})
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(key, val)
+}
+
+// readTolerancePolicy returns the tolerance policy in force
+func (t *SimpleChaincode) readTolerancePolicy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	policy, err := readTolerance(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&policy)
+}
+
+// discrepancies pages through flagged wastes: producer, collector, pageSize,
+// cursor. Empty filters match anything. Callers only see wastes they are a
+// party to unless their role may read any waste.
+func (t *SimpleChaincode) discrepancies(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting producer, collector, pageSize, cursor")
+	}
+	padded := make([]string, 2)
+	copy(padded, args)
+	producer, collector := padded[0], padded[1]
+	var pageArgs []string
+	if len(args) > 2 {
+		pageArgs = args[2:]
+	}
+	pageSize, cursor, err := pager.ParseArgs(pageArgs)
+	if err != nil {
+		return nil, err
+	}
+	readAny, err := permitted(stub, caller.Role, readAnyWaste)
+	if err != nil {
+		return nil, err
+	}
+	var start, end string
+	// a lot merged from several producers is indexed under each of them but
+	// under one retriever, so unfiltered scans go by retriever
+	if collector != "" && producer == "" {
+		start, end, err = statekey.PrefixRange(retrieverDiscrepancyIndex, collector)
+	} else if producer != "" {
+		start, end, err = statekey.PrefixRange(producerDiscrepancyIndex, producer)
+	} else {
+		start, end, err = statekey.PrefixRange(retrieverDiscrepancyIndex)
+	}
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageWastes(stub, start, end, pageSize, cursor, func(waste *Waste) bool {
+		if !readAny && !isParty(waste, caller.User) {
+			return false
+		}
+		return waste.Discrepancy && (collector == "" || waste.Retriever == collector)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Wastes are classified with a code from the European Waste Catalogue. The
+// codes a producer may use live in state under ewc/<code>, maintained by
+// admins with setEwcCode and removeEwcCode. Whether a waste is hazardous
+// comes from its catalogue entry, not from the producer.
+const ewcCatalogue = "ewc"
+
+// EwcEntry is one code of the catalogue
+type EwcEntry struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Hazardous   bool   `json:"hazardous"`
+}
+
+var physicalStates = []string{"solid", "liquid", "sludge", "gas"}
+
+var units = []string{"kg", "l", "m3"}
+
+// normalizeEwcCode accepts a code written as 200301, 20 03 01 or 20 03 01*
+// and returns it as 20 03 01. The asterisk marking hazardous codes is
+// dropped; the catalogue entry says whether the code is hazardous.
+func normalizeEwcCode(code string) (string, error) {
+	digits := strings.TrimSuffix(strings.Replace(strings.TrimSpace(code), " ", "", -1), "*")
+	if len(digits) != 6 {
+		return "", errors.New("{\"Error\":\"Invalid EWC code '" + code + "'. Expecting six digits\"}")
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return "", errors.New("{\"Error\":\"Invalid EWC code '" + code + "'. Expecting six digits\"}")
+		}
+	}
+	return digits[0:2] + " " + digits[2:4] + " " + digits[4:6], nil
+}
+
+func ewcKey(code string) (string, error) {
+	return statekey.Create(ewcCatalogue, code)
+}
+
+// readEwcEntry returns the catalogue entry for a normalized code
+func readEwcEntry(stub shim.ChaincodeStubInterface, code string) (EwcEntry, error) {
+	var entry EwcEntry
+	key, err := ewcKey(code)
+	if err != nil {
+		return entry, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return entry, err
+	}
+	if len(val) == 0 {
+		return entry, errors.New("{\"Error\":\"EWC code " + code + " is not in the catalogue\"}")
+	}
+	err = json.Unmarshal(val, &entry)
+	return entry, err
+}
+
+// classifyWaste validates and sets a waste's EWC code, physical state and unit
+func classifyWaste(stub shim.ChaincodeStubInterface, waste *Waste, code string, physicalState string, unit string) error {
+	code, err := normalizeEwcCode(code)
+	if err != nil {
+		return err
+	}
+	entry, err := readEwcEntry(stub, code)
+	if err != nil {
+		return err
+	}
+	if !contains(physicalStates, physicalState) {
+		return errors.New("{\"Error\":\"Invalid physical state '" + physicalState + "'. Expecting one of " + strings.Join(physicalStates, ", ") + "\"}")
+	}
+	if !contains(units, unit) {
+		return errors.New("{\"Error\":\"Invalid unit '" + unit + "'. Expecting one of " + strings.Join(units, ", ") + "\"}")
+	}
+	waste.EwcCode = entry.Code
+	waste.Hazardous = entry.Hazardous
+	waste.PhysicalState = physicalState
+	waste.Unit = unit
+	return nil
+}
+
+// setEwcCode adds or updates a catalogue entry: code, hazardous, description
+func (t *SimpleChaincode) setEwcCode(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3. code, hazardous, description")
+	}
+	code, err := normalizeEwcCode(args[0])
+	if err != nil {
+		return nil, err
+	}
+	hazardous, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return nil, errors.New("{\"Error\":\"Invalid hazardous flag '" + args[1] + "'. Expecting true or false\"}")
+	}
+	entry := EwcEntry{Code: code, Description: args[2], Hazardous: hazardous}
+	key, err := ewcKey(code)
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&entry)
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(key, val)
+}
+
+// removeEwcCode withdraws a code from the catalogue: code. Wastes already
+// classified with it keep their classification.
+func (t *SimpleChaincode) removeEwcCode(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. code")
+	}
+	code, err := normalizeEwcCode(args[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ewcKey(code)
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.DelState(key)
+}
+
+// readEwcCatalogue lists the catalogue in code order
+func (t *SimpleChaincode) readEwcCatalogue(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	start, end, err := statekey.PrefixRange(ewcCatalogue)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	entries := make([]EwcEntry, 0)
+	for iter.HasNext() {
+		_, val, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry EwcEntry
+		err = json.Unmarshal(val, &entry)
+		if err != nil {
+			return nil, errors.New("Corrupt EWC entry " + string(val))
+		}
+		entries = append(entries, entry)
+	}
+	return json.Marshal(&entries)
+}
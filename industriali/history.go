@@ -0,0 +1,172 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Every write of a waste appends a WasteVersion under
+// waste~history/<id>/<version>. Versions are never rewritten or deleted, so
+// they form an audit trail of the record.
+const historyIndex = "waste~history"
+
+// WasteVersion is one write of a waste: who made it, when, in which
+// transaction, which fields it changed and the record as written
+type WasteVersion struct {
+	Version   uint64        `json:"version"`
+	TxID      string        `json:"txId"`
+	Actor     string        `json:"actor"`
+	Timestamp int64         `json:"timestamp"`
+	Changes   []FieldChange `json:"changes"`
+	Waste     Waste         `json:"waste"`
+}
+
+// FieldChange is a field whose value differs from the previous version. From
+// is null for the first version.
+type FieldChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+}
+
+func historyKey(id string, version uint64) (string, error) {
+	return statekey.Create(historyIndex, id, statekey.Uint(version))
+}
+
+// diffWastes lists the JSON fields that differ between prev, which is nil
+// for a new waste, and waste, in field name order
+func diffWastes(prev *Waste, waste *Waste) ([]FieldChange, error) {
+	before := make(map[string]json.RawMessage)
+	if prev != nil {
+		if err := remarshal(prev, &before); err != nil {
+			return nil, err
+		}
+	}
+	after := make(map[string]json.RawMessage)
+	if err := remarshal(waste, &after); err != nil {
+		return nil, err
+	}
+	fields := make([]string, 0, len(after))
+	for field := range after {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	changes := make([]FieldChange, 0)
+	for _, field := range fields {
+		if field == "version" {
+			continue
+		}
+		from, existed := before[field]
+		if existed && bytes.Equal(from, after[field]) {
+			continue
+		}
+		if !existed {
+			from = json.RawMessage("null")
+		}
+		changes = append(changes, FieldChange{Field: field, From: from, To: after[field]})
+	}
+	return changes, nil
+}
+
+func remarshal(from interface{}, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+// appendHistory records waste, which has just been written by actor, as its
+// next version
+func appendHistory(stub shim.ChaincodeStubInterface, actor string, timestamp int64, prev *Waste, waste *Waste) error {
+	changes, err := diffWastes(prev, waste)
+	if err != nil {
+		return err
+	}
+	version := WasteVersion{
+		Version:   waste.Version,
+		TxID:      stub.GetTxID(),
+		Actor:     actor,
+		Timestamp: timestamp,
+		Changes:   changes,
+		Waste:     *waste,
+	}
+	key, err := historyKey(waste.Id, waste.Version)
+	if err != nil {
+		return err
+	}
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if len(existing) != 0 {
+		return errors.New("{\"Error\":\"History of waste " + waste.Id + " is out of step with the record\"}")
+	}
+	vByte, err := json.Marshal(&version)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, vByte)
+}
+
+// wasteHistory returns every version of a waste, oldest first: id
+func (t *SimpleChaincode) wasteHistory(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. id")
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeWasteRead(stub, caller, &waste)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := statekey.PrefixRange(historyIndex, args[0])
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	versions := make([]WasteVersion, 0)
+	for iter.HasNext() {
+		_, vByte, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var version WasteVersion
+		err = json.Unmarshal(vByte, &version)
+		if err != nil {
+			return nil, errors.New("Corrupt history record " + string(vByte))
+		}
+		versions = append(versions, version)
+	}
+	return json.Marshal(&versions)
+}
@@ -0,0 +1,324 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Producers earn or lose tokens for the quality of their sorting. Admins
+// keep a schedule of points per collected quality under points/<quality>;
+// qualities missing from it earn nothing. Every producer has an account,
+// account/<producer>, and an append-only list of entries,
+// account~entry/<producer>/<seq>. A collection credits (or, for negative
+// points, debits) the producer and remembers the points on the waste, so
+// that correcting the collection reverses exactly what was posted before
+// posting the corrected amount.
+const (
+	pointsTable  = "points"
+	accountTable = "account"
+	ledgerIndex  = "account~entry"
+
+	reasonCollection = "collection"
+	reasonReversal   = "reversal"
+)
+
+// QualityPoints is one line of the points schedule
+type QualityPoints struct {
+	Quality int   `json:"quality"`
+	Points  int64 `json:"points"`
+}
+
+// Account is a producer's token balance. Entries is the number of ledger
+// entries posted to it.
+type Account struct {
+	Holder  string `json:"holder"`
+	Balance int64  `json:"balance"`
+	Entries uint64 `json:"entries"`
+}
+
+// LedgerEntry is one posting to an account
+type LedgerEntry struct {
+	Seq       uint64 `json:"seq"`
+	Holder    string `json:"holder"`
+	WasteId   string `json:"wasteId"`
+	Quality   int    `json:"quality"`
+	Points    int64  `json:"points"`  //negative for a debit
+	Balance   int64  `json:"balance"` //after this entry
+	Reason    string `json:"reason"`  //collection or reversal
+	TxID      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// StatementPage is one page of a statement
+type StatementPage struct {
+	Items      []LedgerEntry `json:"items"`
+	NextCursor string        `json:"nextCursor"`
+}
+
+func pointsKey(quality int) (string, error) {
+	return statekey.Create(pointsTable, statekey.Int(int64(quality)))
+}
+
+// qualityPoints returns the points the schedule awards for a quality
+func qualityPoints(stub shim.ChaincodeStubInterface, quality int) (int64, error) {
+	key, err := pointsKey(quality)
+	if err != nil {
+		return 0, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) == 0 {
+		return 0, nil
+	}
+	var line QualityPoints
+	err = json.Unmarshal(val, &line)
+	if err != nil {
+		return 0, errors.New("Corrupt points schedule entry " + string(val))
+	}
+	return line.Points, nil
+}
+
+func accountKey(holder string) (string, error) {
+	return statekey.Create(accountTable, holder)
+}
+
+func readAccount(stub shim.ChaincodeStubInterface, holder string) (Account, error) {
+	account := Account{Holder: holder}
+	key, err := accountKey(holder)
+	if err != nil {
+		return account, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return account, err
+	}
+	if len(val) == 0 {
+		return account, nil
+	}
+	err = json.Unmarshal(val, &account)
+	if err != nil {
+		return account, errors.New("Corrupt account " + string(val))
+	}
+	return account, nil
+}
+
+// post adds points to an account and appends the entry recording it
+func post(stub shim.ChaincodeStubInterface, waste *Waste, quality int, points int64, reason string, timestamp int64) error {
+	account, err := readAccount(stub, waste.Producer)
+	if err != nil {
+		return err
+	}
+	account.Balance += points
+	account.Entries++
+	entry := LedgerEntry{
+		Seq:       account.Entries,
+		Holder:    account.Holder,
+		WasteId:   waste.Id,
+		Quality:   quality,
+		Points:    points,
+		Balance:   account.Balance,
+		Reason:    reason,
+		TxID:      stub.GetTxID(),
+		Timestamp: timestamp,
+	}
+	key, err := statekey.Create(ledgerIndex, account.Holder, statekey.Uint(entry.Seq))
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, val)
+	if err != nil {
+		return err
+	}
+	key, err = accountKey(account.Holder)
+	if err != nil {
+		return err
+	}
+	val, err = json.Marshal(&account)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, val)
+}
+
+// creditCollection posts the points for a waste's collected quality to its
+// producer and remembers them on the waste. Lots merged from several
+// producers have no single account to credit and earn no points.
+func creditCollection(stub shim.ChaincodeStubInterface, waste *Waste, timestamp int64) error {
+	if waste.Producer == "" {
+		return nil
+	}
+	points, err := qualityPoints(stub, waste.QualityRetrieved)
+	if err != nil {
+		return err
+	}
+	waste.Points = points
+	if points == 0 {
+		return nil
+	}
+	return post(stub, waste, waste.QualityRetrieved, points, reasonCollection, timestamp)
+}
+
+// reverseCollection takes back the points posted for a waste's collection
+func reverseCollection(stub shim.ChaincodeStubInterface, waste *Waste, timestamp int64) error {
+	points := waste.Points
+	waste.Points = 0
+	if points == 0 {
+		return nil
+	}
+	return post(stub, waste, waste.QualityRetrieved, -points, reasonReversal, timestamp)
+}
+
+// setQualityPoints sets the points a quality earns: quality, points. Zero
+// points removes the quality from the schedule. Collections already posted
+// keep their points.
+func (t *SimpleChaincode) setQualityPoints(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. quality, points")
+	}
+	quality, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("{\"Error\":\"Invalid quality '" + args[0] + "'. Expecting an integer\"}")
+	}
+	points, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("{\"Error\":\"Invalid points '" + args[1] + "'. Expecting an integer\"}")
+	}
+	key, err := pointsKey(quality)
+	if err != nil {
+		return nil, err
+	}
+	if points == 0 {
+		return nil, stub.DelState(key)
+	}
+	val, err := json.Marshal(&QualityPoints{Quality: quality, Points: points})
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(key, val)
+}
+
+// readPointsSchedule lists the points schedule in quality order
+func (t *SimpleChaincode) readPointsSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	start, end, err := statekey.PrefixRange(pointsTable)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	schedule := make([]QualityPoints, 0)
+	for iter.HasNext() {
+		_, val, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var line QualityPoints
+		err = json.Unmarshal(val, &line)
+		if err != nil {
+			return nil, errors.New("Corrupt points schedule entry " + string(val))
+		}
+		schedule = append(schedule, line)
+	}
+	return json.Marshal(&schedule)
+}
+
+// authorizeAccountRead lets producers read their own account, and roles
+// that may read any waste read every account
+func authorizeAccountRead(stub shim.ChaincodeStubInterface, caller identity.Caller, holder string) error {
+	if caller.User == holder {
+		return nil
+	}
+	ok, err := permitted(stub, caller.Role, readAnyWaste)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("{\"Error\":\"" + caller.User + " may not read the account of " + holder + "\"}")
+	}
+	return nil
+}
+
+// balance returns a producer's account: producer
+func (t *SimpleChaincode) balance(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. producer")
+	}
+	err := authorizeAccountRead(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+	account, err := readAccount(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&account)
+}
+
+// statement pages through a producer's ledger entries, oldest first:
+// producer, pageSize, cursor
+func (t *SimpleChaincode) statement(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting producer, pageSize, cursor")
+	}
+	holder := args[0]
+	err := authorizeAccountRead(stub, caller, holder)
+	if err != nil {
+		return nil, err
+	}
+	pageSize, cursor, err := pager.ParseArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := statekey.PrefixRange(ledgerIndex, holder)
+	if err != nil {
+		return nil, err
+	}
+	page := StatementPage{Items: make([]LedgerEntry, 0)}
+	page.NextCursor, err = pager.Scan(stub, start, end, pageSize, cursor, func(_ string, val []byte) (bool, error) {
+		var entry LedgerEntry
+		err := json.Unmarshal(val, &entry)
+		if err != nil {
+			return false, errors.New("Corrupt ledger entry " + string(val))
+		}
+		page.Items = append(page.Items, entry)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+)
+
+// Lifecycle states of a waste
+const (
+	stateProduced  = "produced"
+	stateAssigned  = "assigned"
+	stateCollected = "collected"
+	stateDisposed  = "disposed"
+	stateCancelled = "cancelled"
+	stateMerged    = "merged" // consolidated into another lot
+	stateSplit     = "split"  // divided into other lots
+)
+
+// transitions lists the states each state may move to. An assigned waste may
+// be assigned again to hand it to a different collector.
+var transitions = map[string][]string{
+	stateProduced:  {stateAssigned, stateCancelled},
+	stateAssigned:  {stateAssigned, stateCollected, stateCancelled},
+	stateCollected: {stateDisposed, stateMerged, stateSplit},
+	stateDisposed:  {},
+	stateCancelled: {},
+	stateMerged:    {},
+	stateSplit:     {},
+}
+
+// assignAnyWaste is not a function but lets a role assign wastes it did not produce
+const assignAnyWaste = "assignAnyWaste"
+
+// wasteState is where a waste is in its lifecycle. Records written before
+// the state was stored have it derived from their other fields.
+func wasteState(waste *Waste) string {
+	if waste.State != "" {
+		return waste.State
+	}
+	if waste.TimestampRetrieved != 0 {
+		return stateCollected
+	}
+	if waste.Retriever != "" || waste.TimestampAssigned != 0 {
+		return stateAssigned
+	}
+	return stateProduced
+}
+
+// transition moves a waste to a new state, or fails if the lifecycle does not allow it
+func transition(waste *Waste, to string) error {
+	from := wasteState(waste)
+	if !contains(transitions[from], to) {
+		return fmt.Errorf("{\"Error\":\"Waste %s is %s and cannot become %s\"}", waste.Id, from, to)
+	}
+	waste.State = to
+	return nil
+}
+
+// assignWaste names the collector who is to collect a waste: id, collector.
+// Producers may assign their own wastes; roles holding assignAnyWaste may
+// assign any. The collector must be registered, serve the producer, be
+// licensed for the waste's EWC code and have capacity left for it. The SLA
+// clock starts at the first assignment: re-assigning a waste keeps its
+// assignment time and any deadline already set, so a late waste cannot be
+// made punctual by handing it to another collector.
+func (t *SimpleChaincode) assignWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. id, collector")
+	}
+	if args[1] == "" {
+		return nil, errors.New("Collector must not be empty")
+	}
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if waste.Producer != caller.User {
+		ok, err := permitted(stub, caller.Role, assignAnyWaste)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("{\"Error\":\"" + caller.User + " may not assign waste " + waste.Id + "\"}")
+		}
+	}
+	reassigned := wasteState(&waste) == stateAssigned
+	err = transition(&waste, stateAssigned)
+	if err != nil {
+		return nil, err
+	}
+	err = checkAssignment(stub, &waste, args[1])
+	if err != nil {
+		return nil, err
+	}
+	waste.Retriever = args[1]
+	if !reassigned || waste.TimestampAssigned == 0 {
+		waste.TimestampAssigned = timestamp
+	}
+	if !reassigned || waste.CollectionDeadline == 0 {
+		waste.CollectionDeadline, err = collectionDeadline(stub, &waste)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.writeWaste(stub, caller.User, &waste)
+}
+
+// disposeWaste records that the party holding a waste has disposed of it: id
+func (t *SimpleChaincode) disposeWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. id")
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = transition(&waste, stateDisposed)
+	if err != nil {
+		return nil, err
+	}
+	if wasteHolder(&waste) != caller.User {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " is not held by " + caller.User + "\"}")
+	}
+	return t.writeWaste(stub, caller.User, &waste)
+}
+
+// cancelWaste withdraws a waste that has not been collected yet: id. Only its
+// producer may cancel it.
+func (t *SimpleChaincode) cancelWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. id")
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if waste.Producer != caller.User {
+		return nil, errors.New("{\"Error\":\"Waste " + waste.Id + " was not produced by " + caller.User + "\"}")
+	}
+	err = transition(&waste, stateCancelled)
+	if err != nil {
+		return nil, err
+	}
+	return t.writeWaste(stub, caller.User, &waste)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+)
+
+// The holder of collected lots may merge several into one, or split one
+// into several, for example at a transfer station. The parents become
+// merged or split and take no further part in the lifecycle; the children
+// start out collected and held by the caller, with their quantities adding
+// up to exactly those of their parents. Parents list their Children and
+// children their Parents, and every lot remembers the OriginalProducers of
+// the lots it came from, so certificates and lineage queries can trace a
+// lot back to where it was produced. A child keeps the Producer of its
+// parents, which is empty once lots of several producers are merged, so
+// indexes and party checks go by its OriginalProducers instead.
+const (
+	lineageUp   = "up"
+	lineageDown = "down"
+)
+
+// LineageLink is one parent/child edge between lots
+type LineageLink struct {
+	Parent string `json:"parent"`
+	Child  string `json:"child"`
+}
+
+// lotQuantity is how much of a collected lot there is now: the quantity at
+// its last handover, or the quantity it was collected or created with
+func lotQuantity(waste *Waste) int {
+	if len(waste.Custody) != 0 {
+		return waste.Custody[len(waste.Custody)-1].Quantity
+	}
+	return waste.QuantityCollected
+}
+
+// originalProducers returns who produced the lots a waste came from
+func originalProducers(waste *Waste) []string {
+	if len(waste.Parents) != 0 {
+		return waste.OriginalProducers
+	}
+	return []string{waste.Producer}
+}
+
+// readLot reads a lot the caller holds and may merge or split
+func readLot(stub shim.ChaincodeStubInterface, caller identity.Caller, id string) (Waste, error) {
+	waste, err := readWaste(stub, id)
+	if err != nil {
+		return waste, err
+	}
+	if wasteState(&waste) != stateCollected {
+		return waste, errors.New("{\"Error\":\"Waste " + waste.Id + " is " + wasteState(&waste) + "; only collected wastes can be merged or split\"}")
+	}
+	if wasteHolder(&waste) != caller.User {
+		return waste, errors.New("{\"Error\":\"Waste " + waste.Id + " is not held by " + caller.User + "\"}")
+	}
+	return waste, nil
+}
+
+// checkNewLotId fails unless id is free for a new lot and not already taken
+// by another lot of the same transaction
+func checkNewLotId(stub shim.ChaincodeStubInterface, id string, taken []string) error {
+	if id == "" {
+		return errors.New("Waste id must not be empty")
+	}
+	exists, err := wasteExists(stub, id)
+	if err != nil {
+		return err
+	}
+	if exists || contains(taken, id) {
+		return errors.New("{\"Error\":\"Waste " + id + " already exists\"}")
+	}
+	return nil
+}
+
+// newLot creates a collected child lot of parents held by the caller
+func (t *SimpleChaincode) newLot(stub shim.ChaincodeStubInterface, caller identity.Caller, id string, quantity int, parents []Waste, timestamp int64) error {
+	first := parents[0]
+	child := Waste{
+		Id:                id,
+		QuantityProduced:  quantity,
+		TimestampProduced: timestamp,
+		State:             stateCollected,
+		EwcCode:           first.EwcCode,
+		Hazardous:         first.Hazardous,
+		PhysicalState:     first.PhysicalState,
+		Unit:              first.Unit,
+		Holder:            caller.User,
+		QuantityCollected: quantity,
+	}
+	for _, parent := range parents {
+		child.Parents = append(child.Parents, parent.Id)
+		for _, producer := range originalProducers(&parent) {
+			if !contains(child.OriginalProducers, producer) {
+				child.OriginalProducers = append(child.OriginalProducers, producer)
+			}
+		}
+	}
+	sort.Strings(child.OriginalProducers)
+	if len(child.OriginalProducers) == 1 {
+		child.Producer = child.OriginalProducers[0]
+	}
+	_, err := t.writeWaste(stub, caller.User, &child)
+	return err
+}
+
+// mergeWastes consolidates lots the caller holds into a new lot: id,
+// parent, parent, ... The parents must share EWC code, physical state and
+// unit, and the new lot holds their combined quantity.
+func (t *SimpleChaincode) mergeWastes(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, parent, parent, ...")
+	}
+	id := args[0]
+	err := checkNewLotId(stub, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	parents := make([]Waste, 0, len(args)-1)
+	quantity := 0
+	for i, parentId := range args[1:] {
+		if contains(args[1:i+1], parentId) {
+			return nil, errors.New("{\"Error\":\"Waste " + parentId + " is listed twice\"}")
+		}
+		parent, err := readLot(stub, caller, parentId)
+		if err != nil {
+			return nil, err
+		}
+		first := parent
+		if len(parents) != 0 {
+			first = parents[0]
+		}
+		if parent.EwcCode != first.EwcCode || parent.PhysicalState != first.PhysicalState || parent.Unit != first.Unit {
+			return nil, errors.New("{\"Error\":\"Waste " + parent.Id + " differs in EWC code, physical state or unit from waste " + first.Id + "\"}")
+		}
+		parents = append(parents, parent)
+		quantity += lotQuantity(&parent)
+	}
+
+	err = t.newLot(stub, caller, id, quantity, parents, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	for i := range parents {
+		err = transition(&parents[i], stateMerged)
+		if err != nil {
+			return nil, err
+		}
+		parents[i].Children = []string{id}
+		_, err = t.writeWaste(stub, caller.User, &parents[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// splitWaste divides a lot the caller holds into new lots: id, child,
+// quantity, child, quantity, ... The children's quantities must add up to
+// exactly the parent's.
+func (t *SimpleChaincode) splitWaste(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) < 5 || len(args)%2 != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, child, quantity, child, quantity, ...")
+	}
+	timestamp, err := t.now(stub)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := readLot(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(args)/2)
+	quantities := make([]int, 0, len(args)/2)
+	total := 0
+	for i := 1; i < len(args); i += 2 {
+		err = checkNewLotId(stub, args[i], ids)
+		if err != nil {
+			return nil, err
+		}
+		quantity, err := strconv.Atoi(args[i+1])
+		if err != nil || quantity <= 0 {
+			return nil, errors.New("{\"Error\":\"Invalid quantity '" + args[i+1] + "'. Expecting a positive integer\"}")
+		}
+		ids = append(ids, args[i])
+		quantities = append(quantities, quantity)
+		total += quantity
+	}
+	if total != lotQuantity(&parent) {
+		return nil, errors.New("{\"Error\":\"Split quantities add up to " + strconv.Itoa(total) + " but waste " + parent.Id + " holds " + strconv.Itoa(lotQuantity(&parent)) + "\"}")
+	}
+
+	for i, id := range ids {
+		err = t.newLot(stub, caller, id, quantities[i], []Waste{parent}, timestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = transition(&parent, stateSplit)
+	if err != nil {
+		return nil, err
+	}
+	parent.Children = ids
+	return t.writeWaste(stub, caller.User, &parent)
+}
+
+// lineage follows parent/child links from a waste: id, direction. Up lists
+// the links to every lot it came from, down the links to every lot that
+// came from it, nearest first.
+func (t *SimpleChaincode) lineage(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. id, direction")
+	}
+	direction := args[1]
+	if direction != lineageUp && direction != lineageDown {
+		return nil, errors.New("{\"Error\":\"Invalid direction '" + direction + "'. Expecting up or down\"}")
+	}
+	waste, err := readWaste(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = authorizeWasteRead(stub, caller, &waste)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]LineageLink, 0)
+	seen := []string{waste.Id}
+	queue := []Waste{waste}
+	for len(queue) != 0 {
+		lot := queue[0]
+		queue = queue[1:]
+		next := lot.Children
+		if direction == lineageUp {
+			next = lot.Parents
+		}
+		for _, id := range next {
+			if direction == lineageUp {
+				links = append(links, LineageLink{Parent: id, Child: lot.Id})
+			} else {
+				links = append(links, LineageLink{Parent: lot.Id, Child: id})
+			}
+			if contains(seen, id) {
+				continue
+			}
+			seen = append(seen, id)
+			related, err := readWaste(stub, id)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, related)
+		}
+	}
+	return json.Marshal(&links)
+}
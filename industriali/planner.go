@@ -0,0 +1,367 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Admins keep a registry of collectors under collector/<name>: how much a
+// collector can have awaiting collection at once, which producers it serves
+// and which EWC codes it is licensed for. assignWaste only assigns within
+// it, and planAssignments proposes a collector for each unassigned waste
+// from it. Wastes awaiting collection are indexed under
+// assigned~waste/<collector>/<id> so a collector's load is a scan of what it
+// currently holds, not of everything it ever collected.
+const (
+	collectorTable         = "collector"
+	assignedCollectorIndex = "assigned~waste"
+)
+
+// CollectorProfile is a collector's entry in the registry. An empty
+// Producers list means the collector serves every producer.
+type CollectorProfile struct {
+	Collector string   `json:"collector"`
+	Capacity  int      `json:"capacity"` //most it may have assigned and not yet collected, in Unit
+	Unit      string   `json:"unit"`
+	Producers []string `json:"producers"` //service area
+	Licences  []string `json:"licences"`  //EWC codes it may collect
+}
+
+// PlannedAssignment proposes a collector for a waste
+type PlannedAssignment struct {
+	WasteId   string `json:"wasteId"`
+	Collector string `json:"collector"`
+	Quantity  int    `json:"quantity"`
+}
+
+// UnplannedWaste is a waste no collector could take, and why
+type UnplannedWaste struct {
+	WasteId string `json:"wasteId"`
+	Reason  string `json:"reason"`
+}
+
+// AssignmentPlan is the result of planAssignments
+type AssignmentPlan struct {
+	Assignments []PlannedAssignment `json:"assignments"`
+	Unplanned   []UnplannedWaste    `json:"unplanned"`
+	More        bool                `json:"more"` //unassigned wastes beyond the limit remain
+}
+
+func collectorKey(collector string) (string, error) {
+	return statekey.Create(collectorTable, collector)
+}
+
+func assignedIndexKeys(waste *Waste) [][]string {
+	if wasteState(waste) != stateAssigned {
+		return nil
+	}
+	return [][]string{{assignedCollectorIndex, waste.Retriever, waste.Id}}
+}
+
+// splitList reads a comma separated argument; an empty argument is an empty list
+func splitList(arg string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(arg, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && !contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// readCollectors returns the registry in collector order
+func readCollectors(stub shim.ChaincodeStubInterface) ([]CollectorProfile, error) {
+	start, end, err := statekey.PrefixRange(collectorTable)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	profiles := make([]CollectorProfile, 0)
+	for iter.HasNext() {
+		_, val, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var profile CollectorProfile
+		err = json.Unmarshal(val, &profile)
+		if err != nil {
+			return nil, errors.New("Corrupt collector profile " + string(val))
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// readCollector returns a collector's profile, or nil if it is not registered
+func readCollector(stub shim.ChaincodeStubInterface, collector string) (*CollectorProfile, error) {
+	key, err := collectorKey(collector)
+	if err != nil {
+		return nil, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var profile CollectorProfile
+	err = json.Unmarshal(val, &profile)
+	if err != nil {
+		return nil, errors.New("Corrupt collector profile " + string(val))
+	}
+	return &profile, nil
+}
+
+// assignedLoad returns how much a collector has assigned and not yet
+// collected, in unit, leaving out the waste except
+func assignedLoad(stub shim.ChaincodeStubInterface, collector string, unit string, except string) (int, error) {
+	start, end, err := statekey.PrefixRange(assignedCollectorIndex, collector)
+	if err != nil {
+		return 0, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	load := 0
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		id, err := wasteIdFromIndexKey(key)
+		if err != nil {
+			return 0, err
+		}
+		if id == except {
+			continue
+		}
+		waste, err := readWaste(stub, id)
+		if err != nil {
+			return 0, err
+		}
+		if waste.Unit == unit {
+			load += waste.QuantityProduced
+		}
+	}
+	return load, nil
+}
+
+// checkLicensed returns the registry entry of collector, or fails unless it
+// is registered and licensed for the waste's EWC code
+func checkLicensed(stub shim.ChaincodeStubInterface, waste *Waste, collector string) (*CollectorProfile, error) {
+	profile, err := readCollector(stub, collector)
+	if err != nil {
+		return nil, err
+	}
+	if profile == nil {
+		return nil, errors.New("{\"Error\":\"Collector " + collector + " is not registered\"}")
+	}
+	if waste.EwcCode == "" || !contains(profile.Licences, waste.EwcCode) {
+		return nil, errors.New("{\"Error\":\"Collector " + collector + " is not licensed for EWC code '" + waste.EwcCode + "'\"}")
+	}
+	return profile, nil
+}
+
+// checkAssignment fails unless collector is registered, serves the waste's
+// producer, is licensed for its EWC code and has room for it next to what
+// is already assigned to it
+func checkAssignment(stub shim.ChaincodeStubInterface, waste *Waste, collector string) error {
+	profile, err := checkLicensed(stub, waste, collector)
+	if err != nil {
+		return err
+	}
+	if len(profile.Producers) != 0 && !contains(profile.Producers, waste.Producer) {
+		return errors.New("{\"Error\":\"Collector " + collector + " does not serve producer " + waste.Producer + "\"}")
+	}
+	if profile.Unit != waste.Unit {
+		return errors.New("{\"Error\":\"Collector " + collector + " measures capacity in " + profile.Unit + ", not " + waste.Unit + "\"}")
+	}
+	load, err := assignedLoad(stub, collector, profile.Unit, waste.Id)
+	if err != nil {
+		return err
+	}
+	if load+waste.QuantityProduced > profile.Capacity {
+		return errors.New("{\"Error\":\"Collector " + collector + " has only " + strconv.Itoa(profile.Capacity-load) + " " + profile.Unit + " of capacity left\"}")
+	}
+	return nil
+}
+
+// registerCollector adds or replaces a collector in the registry: collector,
+// capacity, unit, producers, licences. Producers and licences are comma
+// separated; no producers means every producer.
+func (t *SimpleChaincode) registerCollector(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5. collector, capacity, unit, producers, licences")
+	}
+	profile := CollectorProfile{Collector: args[0], Unit: args[2], Producers: splitList(args[3]), Licences: make([]string, 0)}
+	if profile.Collector == "" {
+		return nil, errors.New("Collector must not be empty")
+	}
+	capacity, err := strconv.Atoi(args[1])
+	if err != nil || capacity <= 0 {
+		return nil, errors.New("{\"Error\":\"Invalid capacity '" + args[1] + "'. Expecting a positive integer\"}")
+	}
+	profile.Capacity = capacity
+	if !contains(units, profile.Unit) {
+		return nil, errors.New("{\"Error\":\"Invalid unit '" + profile.Unit + "'. Expecting one of " + strings.Join(units, ", ") + "\"}")
+	}
+	for _, code := range splitList(args[4]) {
+		code, err = normalizeEwcCode(code)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(profile.Licences, code) {
+			profile.Licences = append(profile.Licences, code)
+		}
+	}
+	key, err := collectorKey(profile.Collector)
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&profile)
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(key, val)
+}
+
+// removeCollector takes a collector out of the registry: collector. Wastes
+// already assigned to it are unaffected.
+func (t *SimpleChaincode) removeCollector(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1. collector")
+	}
+	key, err := collectorKey(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.DelState(key)
+}
+
+// readCollectorRegistry lists the registry in collector order
+func (t *SimpleChaincode) readCollectorRegistry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	profiles, err := readCollectors(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&profiles)
+}
+
+// planAssignments proposes a collector for unassigned wastes: limit. The
+// first limit wastes are planned in ID order; More reports whether others
+// remain for a later plan, once this one has been carried out. Each goes to
+// the eligible collector with the most capacity left, the first by name on a
+// tie: one that serves its producer, is licensed for its EWC code, measures
+// capacity in its unit and can still fit it after what is already assigned
+// to it and what this plan has given it. Wastes no collector can take are
+// listed with the reason. The plan depends only on state, so every peer
+// returns the same one.
+func (t *SimpleChaincode) planAssignments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting limit")
+	}
+	limit, _, err := pager.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := readCollectors(stub)
+	if err != nil {
+		return nil, err
+	}
+	remaining := make([]int, len(profiles))
+	for i, profile := range profiles {
+		load, err := assignedLoad(stub, profile.Collector, profile.Unit, "")
+		if err != nil {
+			return nil, err
+		}
+		remaining[i] = profile.Capacity - load
+	}
+
+	start, end, err := statekey.PrefixRange(stateWasteIndex, stateProduced)
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageWastes(stub, start, end, limit, "", func(waste *Waste) bool {
+		return wasteState(waste) == stateProduced
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plan := AssignmentPlan{Assignments: make([]PlannedAssignment, 0), Unplanned: make([]UnplannedWaste, 0), More: page.NextCursor != ""}
+	for _, waste := range page.Items {
+		best := -1
+		// how far the closest collector got decides the reason a waste is not planned
+		reasons := []string{
+			"no collector serves producer " + waste.Producer,
+			"no collector serving producer " + waste.Producer + " is licensed for " + waste.EwcCode,
+			"no licensed collector has " + strconv.Itoa(waste.QuantityProduced) + " " + waste.Unit + " of capacity left",
+		}
+		reason := 0
+		for i, profile := range profiles {
+			if len(profile.Producers) != 0 && !contains(profile.Producers, waste.Producer) {
+				continue
+			}
+			if !contains(profile.Licences, waste.EwcCode) {
+				reason = maxInt(reason, 1)
+				continue
+			}
+			if profile.Unit != waste.Unit || remaining[i] < waste.QuantityProduced {
+				reason = 2
+				continue
+			}
+			if best < 0 || remaining[i] > remaining[best] {
+				best = i
+			}
+		}
+		if best < 0 {
+			plan.Unplanned = append(plan.Unplanned, UnplannedWaste{WasteId: waste.Id, Reason: reasons[reason]})
+			continue
+		}
+		remaining[best] -= waste.QuantityProduced
+		plan.Assignments = append(plan.Assignments, PlannedAssignment{WasteId: waste.Id, Collector: profiles[best].Collector, Quantity: waste.QuantityProduced})
+	}
+	return json.Marshal(&plan)
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
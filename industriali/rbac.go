@@ -0,0 +1,195 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Roles are read from the caller's certificate (see package identity). Which
+// functions a role may call is kept in state as permission/<role>/<function>
+// keys, which admins maintain with grantRole and revokeRole. The admin role
+// itself is not in the table: it may always call the admin functions and
+// nothing else, so it cannot lock itself out.
+const (
+	roleAdmin      = "admin"
+	roleProducer   = "producer"
+	roleCollector  = "collector"
+	roleAuditor    = "auditor"
+	roleDispatcher = "dispatcher"
+	roleHandler    = "handler" // transfer stations and treatment plants
+
+	permissionTable = "permission"
+
+	// readAnyWaste is not a function but lets a role read wastes it is not a party to
+	readAnyWaste = "readAnyWaste"
+)
+
+var defaultPermissions = map[string][]string{
+	roleProducer:   {"newWaste", "assignWaste", "cancelWaste", "balance", "statement", "overdue", "readWaste", "custodyChain", "lineage", "verifyCertificate", "wasteHistory", "listWastes", "discrepancies", "tolerance", "pointsSchedule", "slaWindows", "ewcCatalogue"},
+	roleCollector:  {"collect", "correctCollection", "transferWaste", "mergeWastes", "splitWaste", "disposeWaste", "issueCertificate", "overdue", "readWaste", "custodyChain", "lineage", "verifyCertificate", "wasteHistory", "listWastes", "discrepancies", "tolerance", "pointsSchedule", "slaWindows", "ewcCatalogue"},
+	roleHandler:    {"transferWaste", "mergeWastes", "splitWaste", "disposeWaste", "issueCertificate", "readWaste", "custodyChain", "lineage", "verifyCertificate", "wasteHistory", "listWastes", "discrepancies", "tolerance", "pointsSchedule", "slaWindows", "ewcCatalogue"},
+	roleAuditor:    {"balance", "statement", "overdue", "collectors", "readWaste", "custodyChain", "lineage", "verifyCertificate", "wasteHistory", "listWastes", "discrepancies", "tolerance", "pointsSchedule", "slaWindows", "ewcCatalogue", readAnyWaste},
+	roleDispatcher: {"assignWaste", "planAssignments", "collectors", "overdue", "readWaste", "custodyChain", "lineage", "verifyCertificate", "wasteHistory", "listWastes", "discrepancies", "tolerance", "pointsSchedule", "slaWindows", "ewcCatalogue", readAnyWaste, assignAnyWaste},
+}
+
+var adminFunctions = map[string]bool{
+	"grantRole":         true,
+	"revokeRole":        true,
+	"permissions":       true,
+	"setEwcCode":        true,
+	"removeEwcCode":     true,
+	"setTolerance":      true,
+	"setQualityPoints":  true,
+	"setSlaWindow":      true,
+	"registerCollector": true,
+	"removeCollector":   true,
+}
+
+func permissionKey(role string, function string) (string, error) {
+	return statekey.Create(permissionTable, role, function)
+}
+
+// seedPermissions writes the default permission table
+func seedPermissions(stub shim.ChaincodeStubInterface) error {
+	roles := make([]string, 0, len(defaultPermissions))
+	for role := range defaultPermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		for _, function := range defaultPermissions[role] {
+			if err := grant(stub, role, function); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func grant(stub shim.ChaincodeStubInterface, role string, function string) error {
+	key, err := permissionKey(role, function)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte("true"))
+}
+
+func permitted(stub shim.ChaincodeStubInterface, role string, function string) (bool, error) {
+	if role == roleAdmin {
+		return adminFunctions[function], nil
+	}
+	if role == "" || adminFunctions[function] {
+		return false, nil
+	}
+	key, err := permissionKey(role, function)
+	if err != nil {
+		return false, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return len(val) != 0, nil
+}
+
+// authorize fails unless the caller's role may call function
+func authorize(stub shim.ChaincodeStubInterface, caller identity.Caller, function string) error {
+	ok, err := permitted(stub, caller.Role, function)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("{\"Error\":\"%s with role '%s' may not call %s\"}", caller.User, caller.Role, function)
+	}
+	return nil
+}
+
+// authorizeWasteRead fails unless the caller is a party to the waste or may read any waste
+func authorizeWasteRead(stub shim.ChaincodeStubInterface, caller identity.Caller, waste *Waste) error {
+	if isParty(waste, caller.User) {
+		return nil
+	}
+	ok, err := permitted(stub, caller.Role, readAnyWaste)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("{\"Error\":\"" + caller.User + " is not a party to waste " + waste.Id + "\"}")
+	}
+	return nil
+}
+
+// grantRole lets a role call a function: role, function
+func (t *SimpleChaincode) grantRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. role, function")
+	}
+	if args[0] == "" || args[0] == roleAdmin || adminFunctions[args[1]] {
+		return nil, errors.New("The admin role and admin functions are not configurable")
+	}
+	return nil, grant(stub, args[0], args[1])
+}
+
+// revokeRole stops a role from calling a function: role, function
+func (t *SimpleChaincode) revokeRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. role, function")
+	}
+	key, err := permissionKey(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.DelState(key)
+}
+
+// readPermissions lists the functions each role may call, optionally for one role
+func (t *SimpleChaincode) readPermissions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting role or nothing")
+	}
+	start, end, err := statekey.PrefixRange(permissionTable, args...)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	table := make(map[string][]string)
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := statekey.Split(key)
+		if err != nil {
+			return nil, err
+		}
+		table[attrs[0]] = append(table[attrs[0]], attrs[1])
+	}
+	return json.Marshal(table)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		user     string
+		role     string
+		function string
+		args     []string
+		allowed  bool
+	}{
+		{"p1", roleProducer, "newWaste", []string{"w2", "10", "20 03 01", "solid", "kg"}, true},
+		{"c1", roleCollector, "newWaste", []string{"w3", "10", "20 03 01", "solid", "kg"}, false},
+		{"root", roleAdmin, "newWaste", []string{"w4", "10", "20 03 01", "solid", "kg"}, false},
+		{"p1", "", "newWaste", []string{"w5", "10", "20 03 01", "solid", "kg"}, false},
+		{"p1", roleProducer, "grantRole", []string{roleProducer, "collect"}, false},
+		{"p1", roleProducer, "registerCollector", []string{"c2", "100", "kg", "", "20 03 01"}, false},
+		{"root", roleAdmin, "registerCollector", []string{"c2", "100", "kg", "", "20 03 01"}, true},
+		{"p2", roleProducer, "assignWaste", []string{"w1", "c1"}, false},
+		{"d1", roleDispatcher, "assignWaste", []string{"w1", "c1"}, true},
+	}
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "c1", "100", "kg", "", "20 03 01")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	for _, tt := range tests {
+		err := net.invoke(tt.user, tt.role, tt.function, tt.args...)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s as %s (%s): error = %v, allowed %v", tt.function, tt.user, tt.role, err, tt.allowed)
+		}
+	}
+}
+
+func TestGrantAndRevoke(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "revokeRole", roleProducer, "newWaste")
+	if err := net.invoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg"); err == nil {
+		t.Error("newWaste succeeded after it was revoked")
+	}
+	net.mustInvoke("root", roleAdmin, "grantRole", roleProducer, "newWaste")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	if err := net.invoke("root", roleAdmin, "grantRole", roleProducer, "setTolerance"); err == nil {
+		t.Error("granting an admin function succeeded")
+	}
+}
+
+func TestReadWasteAccess(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	tests := []struct {
+		user    string
+		role    string
+		allowed bool
+	}{
+		{"p1", roleProducer, true},
+		{"p2", roleProducer, false},
+		{"a1", roleAuditor, true},
+		{"root", roleAdmin, false},
+	}
+	for _, tt := range tests {
+		_, err := net.query(tt.user, tt.role, "readWaste", "w1")
+		if (err == nil) != tt.allowed {
+			t.Errorf("readWaste as %s (%s): error = %v, allowed %v", tt.user, tt.role, err, tt.allowed)
+		}
+	}
+}
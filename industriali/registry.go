@@ -0,0 +1,245 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// Every waste is registered under waste~id/<id>, and under
+// producer~waste/<producer>/<id>, retriever~waste/<retriever>/<id>,
+// state~waste/<state>/<id>, ewc~waste/<code>/<id> and
+// hazard~waste/<hazardous>/<id> so that listWastes can scan only the wastes
+// matching its most selective filter. Flagged wastes are also indexed for
+// the discrepancies query (see discrepancy.go), wastes awaiting
+// collection under an SLA for the overdue query (see sla.go), and assigned
+// wastes by collector for its load (see planner.go). writeWaste keeps these
+// keys in step with the record.
+const (
+	wasteRegistry       = "waste~id"
+	producerWasteIndex  = "producer~waste"
+	retrieverWasteIndex = "retriever~waste"
+	stateWasteIndex     = "state~waste"
+	ewcWasteIndex       = "ewc~waste"
+	hazardWasteIndex    = "hazard~waste"
+)
+
+func wasteIndexKeys(waste *Waste) ([]string, error) {
+	attrs := [][]string{
+		{wasteRegistry, waste.Id},
+		{stateWasteIndex, wasteState(waste), waste.Id},
+	}
+	// lots merged from several producers are listed under each of them
+	for _, producer := range originalProducers(waste) {
+		attrs = append(attrs, []string{producerWasteIndex, producer, waste.Id})
+	}
+	if waste.Retriever != "" {
+		attrs = append(attrs, []string{retrieverWasteIndex, waste.Retriever, waste.Id})
+	}
+	// wastes recorded before classification existed have no code
+	if waste.EwcCode != "" {
+		attrs = append(attrs, []string{ewcWasteIndex, waste.EwcCode, waste.Id})
+		attrs = append(attrs, []string{hazardWasteIndex, strconv.FormatBool(waste.Hazardous), waste.Id})
+	}
+	attrs = append(attrs, discrepancyIndexKeys(waste)...)
+	attrs = append(attrs, deadlineIndexKeys(waste)...)
+	attrs = append(attrs, assignedIndexKeys(waste)...)
+	keys := make([]string, len(attrs))
+	for i, a := range attrs {
+		key, err := statekey.Create(a[0], a[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// updateWasteIndexes moves a waste's index keys from those of prev, which
+// is nil for a new waste, to those of waste
+func updateWasteIndexes(stub shim.ChaincodeStubInterface, prev *Waste, waste *Waste) error {
+	keys, err := wasteIndexKeys(waste)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		old, err := wasteIndexKeys(prev)
+		if err != nil {
+			return err
+		}
+		for _, key := range old {
+			if !contains(keys, key) {
+				err = stub.DelState(key)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, key := range keys {
+		err = stub.PutState(key, statekey.IndexValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// wasteIdFromIndexKey returns the waste ID, which is always the last
+// attribute of a waste index key
+func wasteIdFromIndexKey(key string) (string, error) {
+	_, attrs, err := statekey.Split(key)
+	if err != nil {
+		return "", err
+	}
+	if len(attrs) == 0 {
+		return "", errors.New("Corrupt index key " + key)
+	}
+	return attrs[len(attrs)-1], nil
+}
+
+// WasteFilter selects wastes; empty fields match anything. Hazardous is
+// "true", "false" or empty.
+type WasteFilter struct {
+	Producer  string
+	Retriever string
+	State     string
+	EwcCode   string
+	Hazardous string
+}
+
+func (f *WasteFilter) matches(waste *Waste) bool {
+	return (f.Producer == "" || contains(originalProducers(waste), f.Producer)) &&
+		(f.Retriever == "" || f.Retriever == waste.Retriever) &&
+		(f.State == "" || f.State == wasteState(waste)) &&
+		(f.EwcCode == "" || f.EwcCode == waste.EwcCode) &&
+		(f.Hazardous == "" || (waste.EwcCode != "" && f.Hazardous == strconv.FormatBool(waste.Hazardous)))
+}
+
+// indexRange picks the index that narrows the scan the most
+func (f *WasteFilter) indexRange() (string, string, error) {
+	if f.Producer != "" {
+		return statekey.PrefixRange(producerWasteIndex, f.Producer)
+	}
+	if f.Retriever != "" {
+		return statekey.PrefixRange(retrieverWasteIndex, f.Retriever)
+	}
+	if f.EwcCode != "" {
+		return statekey.PrefixRange(ewcWasteIndex, f.EwcCode)
+	}
+	if f.State != "" {
+		return statekey.PrefixRange(stateWasteIndex, f.State)
+	}
+	if f.Hazardous != "" {
+		return statekey.PrefixRange(hazardWasteIndex, f.Hazardous)
+	}
+	return statekey.PrefixRange(wasteRegistry)
+}
+
+// WastePage is one page of listWastes
+type WastePage struct {
+	Items      []Waste `json:"items"`
+	NextCursor string  `json:"nextCursor"`
+}
+
+// pageWastes pages through the index keys in [start, end) and returns the
+// wastes they refer to that keep accepts
+func pageWastes(stub shim.ChaincodeStubInterface, start string, end string, pageSize int, cursor string, keep func(*Waste) bool) (WastePage, error) {
+	page := WastePage{Items: make([]Waste, 0)}
+	next, err := pager.Scan(stub, start, end, pageSize, cursor, func(key string, _ []byte) (bool, error) {
+		id, err := wasteIdFromIndexKey(key)
+		if err != nil {
+			return false, err
+		}
+		waste, err := readWaste(stub, id)
+		if err != nil {
+			return false, err
+		}
+		if !keep(&waste) {
+			return false, nil
+		}
+		page.Items = append(page.Items, waste)
+		return true, nil
+	})
+	page.NextCursor = next
+	return page, err
+}
+
+// listWastes pages through registered wastes: producer, retriever, state,
+// ewcCode, hazardous, pageSize, cursor. Empty filters match anything.
+// Callers only see wastes they are a party to unless their role may read
+// any waste.
+func (t *SimpleChaincode) listWastes(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) > 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting producer, retriever, state, ewcCode, hazardous, pageSize, cursor")
+	}
+	padded := make([]string, 5)
+	copy(padded, args)
+	filter := WasteFilter{Producer: padded[0], Retriever: padded[1], State: padded[2], Hazardous: padded[4]}
+	if padded[3] != "" {
+		code, err := normalizeEwcCode(padded[3])
+		if err != nil {
+			return nil, err
+		}
+		filter.EwcCode = code
+	}
+	if filter.Hazardous != "" && filter.Hazardous != "true" && filter.Hazardous != "false" {
+		return nil, errors.New("{\"Error\":\"Invalid hazardous filter '" + filter.Hazardous + "'. Expecting true, false or nothing\"}")
+	}
+	var pageArgs []string
+	if len(args) > 5 {
+		pageArgs = args[5:]
+	}
+	pageSize, cursor, err := pager.ParseArgs(pageArgs)
+	if err != nil {
+		return nil, err
+	}
+	readAny, err := permitted(stub, caller.Role, readAnyWaste)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := filter.indexRange()
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageWastes(stub, start, end, pageSize, cursor, func(waste *Waste) bool {
+		if !readAny && !isParty(waste, caller.User) {
+			return false
+		}
+		return filter.matches(waste)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
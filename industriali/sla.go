@@ -0,0 +1,214 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+	"github.com/iorfix/learn-chaincode/pager"
+	"github.com/iorfix/learn-chaincode/statekey"
+)
+
+// An assigned waste must be collected within an SLA window. Windows are kept
+// in state under sla/<scope>/<name>, either for a collector's contract or
+// for an EWC code; a collector's contract takes precedence over the code.
+// The first assignment fixes the waste's CollectionDeadline, which
+// re-assignment keeps, and while the waste awaits collection it is indexed
+// under deadline~waste/<deadline>/<id> so that overdue is a single range
+// scan. A collection after the deadline sets SlaBreached on the waste.
+const (
+	slaTable      = "sla"
+	deadlineIndex = "deadline~waste"
+
+	slaScopeCollector = "collector"
+	slaScopeEwc       = "ewc"
+
+	msPerHour = 3600 * 1000
+)
+
+// SlaWindow is how many hours a collector or an EWC code allows between
+// assignment and collection
+type SlaWindow struct {
+	Scope string `json:"scope"` //collector or ewc
+	Name  string `json:"name"`  //the collector, or the EWC code
+	Hours int64  `json:"hours"`
+}
+
+func slaKey(scope string, name string) (string, error) {
+	return statekey.Create(slaTable, scope, name)
+}
+
+func readSlaWindow(stub shim.ChaincodeStubInterface, scope string, name string) (*SlaWindow, error) {
+	key, err := slaKey(scope, name)
+	if err != nil {
+		return nil, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	var window SlaWindow
+	err = json.Unmarshal(val, &window)
+	if err != nil {
+		return nil, errors.New("Corrupt SLA window " + string(val))
+	}
+	return &window, nil
+}
+
+// collectionDeadline returns when an assigned waste must be collected by,
+// or 0 if no SLA window applies to it
+func collectionDeadline(stub shim.ChaincodeStubInterface, waste *Waste) (int64, error) {
+	window, err := readSlaWindow(stub, slaScopeCollector, waste.Retriever)
+	if err != nil {
+		return 0, err
+	}
+	if window == nil && waste.EwcCode != "" {
+		window, err = readSlaWindow(stub, slaScopeEwc, waste.EwcCode)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if window == nil {
+		return 0, nil
+	}
+	return waste.TimestampAssigned + window.Hours*msPerHour, nil
+}
+
+// deadlineIndexKeys returns the key indexing a waste that awaits collection
+// under an SLA
+func deadlineIndexKeys(waste *Waste) [][]string {
+	if waste.CollectionDeadline == 0 || wasteState(waste) != stateAssigned {
+		return nil
+	}
+	return [][]string{{deadlineIndex, statekey.Int(waste.CollectionDeadline), waste.Id}}
+}
+
+// setSlaWindow sets the collection window of a collector's contract or of
+// an EWC code: scope (collector or ewc), name, hours. Zero hours removes the
+// window. Wastes already assigned keep their deadline.
+func (t *SimpleChaincode) setSlaWindow(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3. scope, name, hours")
+	}
+	window := SlaWindow{Scope: args[0], Name: args[1]}
+	switch window.Scope {
+	case slaScopeCollector:
+		if window.Name == "" {
+			return nil, errors.New("Collector must not be empty")
+		}
+	case slaScopeEwc:
+		code, err := normalizeEwcCode(window.Name)
+		if err != nil {
+			return nil, err
+		}
+		window.Name = code
+	default:
+		return nil, errors.New("{\"Error\":\"Invalid SLA scope '" + window.Scope + "'. Expecting collector or ewc\"}")
+	}
+	hours, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || hours < 0 {
+		return nil, errors.New("{\"Error\":\"Invalid hours '" + args[2] + "'. Expecting a non-negative integer\"}")
+	}
+	window.Hours = hours
+	key, err := slaKey(window.Scope, window.Name)
+	if err != nil {
+		return nil, err
+	}
+	if hours == 0 {
+		return nil, stub.DelState(key)
+	}
+	val, err := json.Marshal(&window)
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(key, val)
+}
+
+// readSlaWindows lists every SLA window, collectors' contracts first
+func (t *SimpleChaincode) readSlaWindows(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	start, end, err := statekey.PrefixRange(slaTable)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	windows := make([]SlaWindow, 0)
+	for iter.HasNext() {
+		_, val, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var window SlaWindow
+		err = json.Unmarshal(val, &window)
+		if err != nil {
+			return nil, errors.New("Corrupt SLA window " + string(val))
+		}
+		windows = append(windows, window)
+	}
+	return json.Marshal(&windows)
+}
+
+// overdue pages through the wastes still awaiting collection whose deadline
+// was before a time, earliest deadline first: asOf, pageSize, cursor. Callers
+// only see wastes they are a party to unless their role may read any waste.
+func (t *SimpleChaincode) overdue(stub shim.ChaincodeStubInterface, caller identity.Caller, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting asOf, pageSize, cursor")
+	}
+	asOf, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("{\"Error\":\"Invalid timestamp '" + args[0] + "'. Expecting milliseconds since the epoch\"}")
+	}
+	pageSize, cursor, err := pager.ParseArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	readAny, err := permitted(stub, caller.Role, readAnyWaste)
+	if err != nil {
+		return nil, err
+	}
+	start, _, err := statekey.PrefixRange(deadlineIndex)
+	if err != nil {
+		return nil, err
+	}
+	// a deadline equal to asOf has not passed yet
+	end, err := statekey.Create(deadlineIndex, statekey.Int(asOf))
+	if err != nil {
+		return nil, err
+	}
+	page, err := pageWastes(stub, start, end, pageSize, cursor, func(waste *Waste) bool {
+		return readAny || isParty(waste, caller.User)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&page)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestReassignKeepsDeadline(t *testing.T) {
+	net := deploy(t, new(SimpleChaincode), "0")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "c1", "100", "kg", "", "20 03 01")
+	net.mustInvoke("root", roleAdmin, "registerCollector", "c2", "100", "kg", "", "20 03 01")
+	net.mustInvoke("root", roleAdmin, "setSlaWindow", slaScopeCollector, "c1", "1")
+	net.mustInvoke("root", roleAdmin, "setSlaWindow", slaScopeCollector, "c2", "48")
+	net.mustInvoke("p1", roleProducer, "newWaste", "w1", "10", "20 03 01", "solid", "kg")
+	net.mustInvoke("p1", roleProducer, "assignWaste", "w1", "c1")
+	first := net.waste("w1")
+	if first.CollectionDeadline != first.TimestampAssigned+msPerHour {
+		t.Fatalf("CollectionDeadline = %d, want %d", first.CollectionDeadline, first.TimestampAssigned+msPerHour)
+	}
+
+	// the deadline has passed when the waste is handed to a collector with a longer window
+	net.stub.Timestamp += 2 * msPerHour
+	net.mustInvoke("p1", roleProducer, "assignWaste", "w1", "c2")
+	waste := net.waste("w1")
+	if waste.Retriever != "c2" || waste.TimestampAssigned != first.TimestampAssigned || waste.CollectionDeadline != first.CollectionDeadline {
+		t.Errorf("re-assigned to %s at %d with deadline %d; want c2 at %d with deadline %d",
+			waste.Retriever, waste.TimestampAssigned, waste.CollectionDeadline, first.TimestampAssigned, first.CollectionDeadline)
+	}
+	net.mustInvoke("c2", roleCollector, "collect", "w1", "5", "10")
+	if !net.waste("w1").SlaBreached {
+		t.Error("collection after the original deadline did not breach the SLA")
+	}
+}
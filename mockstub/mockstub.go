@@ -0,0 +1,133 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mockstub is an in-memory chaincode stub for unit tests.
+//
+// It keeps state in a map, serves range queries in key order, and answers
+// ReadCertAttribute from Attrs, so tests can act as any caller without a
+// membership service. Stub methods the chaincodes do not use panic.
+package mockstub
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/iorfix/learn-chaincode/identity"
+)
+
+// Stub is a ChaincodeStubInterface backed by memory
+type Stub struct {
+	shim.ChaincodeStubInterface
+
+	State     map[string][]byte
+	Attrs     map[string]string //certificate attributes
+	TxID      string
+	Timestamp int64 //transaction timestamp in ms
+}
+
+// New returns a stub with empty state and no caller
+func New() *Stub {
+	return &Stub{State: make(map[string][]byte), Attrs: make(map[string]string), TxID: "tx"}
+}
+
+// SetCaller makes the following transactions carry user and role in their
+// certificate. An empty role leaves the attribute out.
+func (s *Stub) SetCaller(user string, role string) {
+	s.Attrs = map[string]string{identity.UserAttribute: user}
+	if role != "" {
+		s.Attrs[identity.RoleAttribute] = role
+	}
+}
+
+// GetState returns the value of key, or nil if it is not set
+func (s *Stub) GetState(key string) ([]byte, error) {
+	return s.State[key], nil
+}
+
+// PutState sets key. Like the ledger, it treats an empty value as a delete.
+func (s *Stub) PutState(key string, value []byte) error {
+	if len(value) == 0 {
+		return s.DelState(key)
+	}
+	s.State[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// DelState removes key
+func (s *Stub) DelState(key string) error {
+	delete(s.State, key)
+	return nil
+}
+
+// RangeQueryState iterates over the keys in [startKey, endKey) in key order
+func (s *Stub) RangeQueryState(startKey string, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	keys := make([]string, 0)
+	for key := range s.State {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &iterator{stub: s, keys: keys}, nil
+}
+
+// GetTxID returns TxID
+func (s *Stub) GetTxID() string {
+	return s.TxID
+}
+
+// GetTxTimestamp returns Timestamp
+func (s *Stub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.Timestamp / 1000, Nanos: int32(s.Timestamp%1000) * 1000000}, nil
+}
+
+// GetPayload returns no payload
+func (s *Stub) GetPayload() ([]byte, error) {
+	return nil, nil
+}
+
+// ReadCertAttribute returns an attribute from Attrs
+func (s *Stub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	val, ok := s.Attrs[attributeName]
+	if !ok {
+		return nil, errors.New("Attribute '" + attributeName + "' not found")
+	}
+	return []byte(val), nil
+}
+
+type iterator struct {
+	stub *Stub
+	keys []string
+}
+
+func (it *iterator) HasNext() bool {
+	return len(it.keys) != 0
+}
+
+func (it *iterator) Next() (string, []byte, error) {
+	if len(it.keys) == 0 {
+		return "", nil, errors.New("No more keys")
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	return key, it.stub.State[key], nil
+}
+
+func (it *iterator) Close() error {
+	return nil
+}
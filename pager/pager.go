@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pager pages through a key range of chaincode state.
+//
+// A page ends once it holds the requested number of items, or once it has
+// visited MaxVisits keys, so a filter that keeps few keys cannot make one
+// call walk a whole index. Its cursor is the encoded key the next page starts
+// at, so pages stay stable while keys are added elsewhere in the range; the
+// cursor is empty on the last page. A page cut short by MaxVisits may hold
+// fewer items than asked for, or none, and still have a cursor.
+//
+// This relies on RangeQueryState returning keys in ascending order, which
+// the v0.6 shim does not promise but its key-ordered state store provides.
+// Scan checks the order and fails rather than hand out a cursor that could
+// skip or repeat keys. The v0.6 range also includes its end key; no
+// composite key equals the end of a statekey range, but Scan stops there
+// anyway.
+package pager
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	DefaultSize = 100
+	MaxSize     = 1000
+	MaxVisits   = 10 * MaxSize
+)
+
+// ParseArgs reads the optional trailing pageSize and cursor arguments
+func ParseArgs(args []string) (int, string, error) {
+	if len(args) > 2 {
+		return 0, "", errors.New("Incorrect number of arguments. Expecting pageSize, cursor")
+	}
+	size := DefaultSize
+	cursor := ""
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		size, err = strconv.Atoi(args[0])
+		if err != nil || size < 1 || size > MaxSize {
+			return 0, "", fmt.Errorf("Invalid page size %q. Expecting 1 to %d", args[0], MaxSize)
+		}
+	}
+	if len(args) > 1 {
+		cursor = args[1]
+	}
+	return size, cursor, nil
+}
+
+// Scan walks the keys in [start, end) in key order, resuming at cursor, and
+// passes each to visit until visit has kept size of them or MaxVisits keys
+// have been visited. It returns the cursor of the following page.
+func Scan(stub shim.ChaincodeStubInterface, start string, end string, size int, cursor string, visit func(key string, value []byte) (bool, error)) (string, error) {
+	if cursor != "" {
+		resume, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || string(resume) < start || string(resume) >= end {
+			return "", errors.New("Invalid cursor " + cursor)
+		}
+		start = string(resume)
+	}
+	iter, err := stub.RangeQueryState(start, end)
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+
+	kept, visited := 0, 0
+	prev := ""
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return "", err
+		}
+		if key >= end {
+			break
+		}
+		if key < start || (prev != "" && key <= prev) {
+			return "", errors.New("Range query returned key " + key + " out of order")
+		}
+		prev = key
+		if kept == size || visited == MaxVisits {
+			return base64.RawURLEncoding.EncodeToString([]byte(key)), nil
+		}
+		visited++
+		ok, err := visit(key, value)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			kept++
+		}
+	}
+	return "", nil
+}
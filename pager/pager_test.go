@@ -0,0 +1,46 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pager_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/iorfix/learn-chaincode/mockstub"
+	"github.com/iorfix/learn-chaincode/pager"
+)
+
+func TestScanCapsVisits(t *testing.T) {
+	stub := mockstub.New()
+	for i := 0; i < pager.MaxVisits+5; i++ {
+		stub.State[fmt.Sprintf("k%06d", i)] = []byte{0}
+	}
+	visited := 0
+	skip := func(string, []byte) (bool, error) {
+		visited++
+		return false, nil
+	}
+	cursor, err := pager.Scan(stub, "k", "l", 1, "", skip)
+	if err != nil || cursor == "" || visited != pager.MaxVisits {
+		t.Fatalf("first page visited %d keys, cursor %q, err %v; want %d keys and a cursor", visited, cursor, err, pager.MaxVisits)
+	}
+	visited = 0
+	cursor, err = pager.Scan(stub, "k", "l", 1, cursor, skip)
+	if err != nil || cursor != "" || visited != 5 {
+		t.Errorf("second page visited %d keys, cursor %q, err %v; want 5 keys and no cursor", visited, cursor, err)
+	}
+}
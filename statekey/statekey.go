@@ -0,0 +1,114 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statekey builds namespaced composite keys for chaincode state.
+//
+// Keys use the same layout as later fabric releases (a leading U+0000, then the
+// object type and every attribute each terminated by U+0000), so they never
+// collide with the plain keys the chaincodes used to write and can be scanned
+// by prefix with RangeQueryState.
+package statekey
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	separator = "\x00"
+	maxRune   = string(utf8.MaxRune)
+)
+
+// IndexValue is stored under index keys. They carry no data, but the ledger
+// treats an empty value as a delete.
+var IndexValue = []byte{0x00}
+
+// Create joins objectType and attrs into a composite key.
+func Create(objectType string, attrs ...string) (string, error) {
+	if err := validate(objectType); err != nil {
+		return "", err
+	}
+	key := separator + objectType + separator
+	for _, attr := range attrs {
+		if err := validate(attr); err != nil {
+			return "", err
+		}
+		key += attr + separator
+	}
+	return key, nil
+}
+
+// Split returns the object type and attributes of a composite key.
+func Split(key string) (string, []string, error) {
+	if !strings.HasPrefix(key, separator) || !strings.HasSuffix(key, separator) {
+		return "", nil, errors.New("Not a composite key: " + key)
+	}
+	parts := strings.Split(key[1:len(key)-1], separator)
+	return parts[0], parts[1:], nil
+}
+
+// PrefixRange returns the start and end keys that RangeQueryState needs to
+// visit every key whose leading attributes are attrs.
+func PrefixRange(objectType string, attrs ...string) (string, string, error) {
+	start, err := Create(objectType, attrs...)
+	if err != nil {
+		return "", "", err
+	}
+	return start, start + maxRune, nil
+}
+
+// PartialRange is PrefixRange with one more, incomplete attribute: it covers
+// every key whose leading attributes are attrs and whose next attribute
+// starts with partial.
+func PartialRange(objectType string, attrs []string, partial string) (string, string, error) {
+	start, err := Create(objectType, attrs...)
+	if err != nil {
+		return "", "", err
+	}
+	if err := validate(partial); err != nil {
+		return "", "", err
+	}
+	start += partial
+	return start, start + maxRune, nil
+}
+
+// After returns the smallest key that sorts strictly after key, which is
+// where a range query resumes once key has been consumed.
+func After(key string) string {
+	return key + separator
+}
+
+// Uint pads v so that keys holding numeric attributes sort numerically.
+func Uint(v uint64) string {
+	return fmt.Sprintf("%020d", v)
+}
+
+// Int is Uint for signed values: negative values sort before positive ones.
+func Int(v int64) string {
+	return Uint(uint64(v) ^ 1<<63)
+}
+
+func validate(s string) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("Key component %q is not valid UTF-8", s)
+	}
+	if strings.Contains(s, separator) || strings.Contains(s, maxRune) {
+		return fmt.Errorf("Key component %q contains a reserved character", s)
+	}
+	return nil
+}
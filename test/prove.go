@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
-	"time"
 	"encoding/binary"
+
+	"github.com/iorfix/learn-chaincode/txclock"
 )
 
+// pinned so the output is reproducible
+var clock txclock.Clock = txclock.Fixed(1476748800000)
+
 func main() {
 
 	fmt.Println("Hello, playground")
@@ -39,7 +43,6 @@ func main() {
 }
 
 func makeTimestamp() uint32 {
-	var now int64 
-	now = time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
-    return uint32(now)
+	now, _ := clock.Now(nil)
+	return uint32(now)
 }
\ No newline at end of file
@@ -0,0 +1,65 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package txclock gives chaincode a notion of "now" that every endorsing peer
+// agrees on. Reading the wall clock would let peers compute different values
+// for the same transaction, so time is taken from the transaction itself.
+package txclock
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Clock returns the current time in milliseconds since the Unix epoch.
+type Clock interface {
+	Now(stub shim.ChaincodeStubInterface) (int64, error)
+}
+
+// Tx is the Clock chaincode should use in production: it reports the
+// timestamp the submitting client put on the transaction.
+type Tx struct{}
+
+// Now returns the transaction timestamp in milliseconds.
+func (Tx) Now(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, errors.New("Couldn't get transaction timestamp. Error: " + err.Error())
+	}
+	if ts == nil {
+		return 0, errors.New("Transaction has no timestamp")
+	}
+	return ts.Seconds*1000 + int64(ts.Nanos)/1000000, nil
+}
+
+// Fixed is a test double that always reports the same instant, in
+// milliseconds. It ignores the stub, so it can be used without one.
+type Fixed int64
+
+// Now returns f.
+func (f Fixed) Now(stub shim.ChaincodeStubInterface) (int64, error) {
+	return int64(f), nil
+}
+
+// Or returns c, or Tx if c is nil, so a zero-valued chaincode struct uses the
+// transaction clock.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Tx{}
+	}
+	return c
+}